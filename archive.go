@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveFormats map format name to content type and file extension
+var archiveFormats = map[string][2]string{
+	"zip":    {"application/zip", ".zip"},
+	"tar":    {"application/x-tar", ".tar"},
+	"tar.gz": {"application/gzip", ".tar.gz"},
+	"tgz":    {"application/gzip", ".tar.gz"},
+}
+
+// archiveWriter write entries one by one, content of the entry is written to the returned writer
+type archiveWriter interface {
+	WriteEntry(name string, finfo os.FileInfo, linkname string) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) WriteEntry(name string, finfo os.FileInfo, linkname string) (io.Writer, error) {
+	header, err := zip.FileInfoHeader(finfo)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	switch {
+	case finfo.IsDir():
+		header.Name += "/"
+	case finfo.Mode()&os.ModeSymlink != 0:
+		w, err := a.zw.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(w, linkname) // symlink target is stored as content in zip
+		return nil, err
+	default:
+		header.Method = zip.Deflate
+	}
+	return a.zw.CreateHeader(header)
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gw *gzip.Writer // nil when not compressed
+}
+
+func (a *tarArchive) WriteEntry(name string, finfo os.FileInfo, linkname string) (io.Writer, error) {
+	header, err := tar.FileInfoHeader(finfo, linkname)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	if finfo.IsDir() {
+		header.Name += "/"
+	}
+	if err := a.tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return a.tw, nil
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gw != nil {
+		return a.gw.Close()
+	}
+	return nil
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case "zip":
+		return &zipArchive{zw: zip.NewWriter(w)}, nil
+	case "tar":
+		return &tarArchive{tw: tar.NewWriter(w)}, nil
+	case "tar.gz", "tgz":
+		gw := gzip.NewWriter(w)
+		return &tarArchive{tw: tar.NewWriter(gw), gw: gw}, nil
+	default:
+		return nil, fmt.Errorf("unknown archive format: %q, should be one of zip, tar, tar.gz", format)
+	}
+}
+
+// ArchiveFilter decide which files are archived, patterns are the same as glob of /finfo.
+// Excluded directories are not walked into, include only applies to files.
+type ArchiveFilter struct {
+	Includes []string
+	Excludes []string
+}
+
+// globMatch match relpath with any of the patterns, pattern contains / is matched with the whole relpath,
+// otherwise the base name
+func globMatch(patterns []string, relpath string) bool {
+	for _, pattern := range patterns {
+		name := path.Base(relpath)
+		if strings.Contains(pattern, "/") {
+			name = relpath
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveBaseName is the top directory name in archive, and the download file name
+func archiveBaseName(src string) string {
+	base := filepath.Base(src)
+	if base == string(filepath.Separator) || base == "." {
+		return "root"
+	}
+	return base
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// copyTarEntry copy exactly size bytes declared in the tar header. The file may grow or shrink after stat,
+// eg: logs, data appended is not archived and missing data is filled with zeros.
+func copyTarEntry(w io.Writer, rd io.Reader, size int64) error {
+	n, err := io.CopyN(w, rd, size)
+	if err == io.EOF {
+		_, err = io.CopyN(w, zeroReader{}, size-n)
+	}
+	return err
+}
+
+// writeArchive walk src and stream it into w, entries are put under the directory of src's base name.
+// Symlinks are archived as links and not followed. Files can not be read are skipped.
+func writeArchive(w io.Writer, format, src string, filter ArchiveFilter) error {
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	base := archiveBaseName(src)
+	err = filepath.Walk(src, func(p string, finfo os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(src, p)
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			if p == src {
+				return err
+			}
+			log.Printf("archive %s skip %s: %v", src, p, err)
+			return nil
+		}
+		if rel != "." && globMatch(filter.Excludes, rel) {
+			if finfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if finfo.IsDir() {
+			if len(filter.Includes) > 0 {
+				return nil // parent directories are created when extract
+			}
+		} else if len(filter.Includes) > 0 && !globMatch(filter.Includes, rel) {
+			return nil
+		}
+		var linkname string
+		if finfo.Mode()&os.ModeSymlink != 0 {
+			if linkname, err = os.Readlink(p); err != nil {
+				return nil
+			}
+		} else if !finfo.IsDir() && !finfo.Mode().IsRegular() {
+			return nil // device, socket and pipe
+		}
+		var f *os.File
+		if finfo.Mode().IsRegular() {
+			if f, err = os.Open(p); err != nil {
+				log.Printf("archive %s skip %s: %v", src, p, err)
+				return nil
+			}
+			defer f.Close()
+		}
+		ew, err := aw.WriteEntry(path.Join(base, rel), finfo, linkname)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			return nil
+		}
+		if _, ok := aw.(*tarArchive); ok {
+			return copyTarEntry(ew, f, finfo.Size())
+		}
+		_, err = io.Copy(ew, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return aw.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteArchive(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	src := filepath.Join(tmpdir, "results")
+	os.MkdirAll(filepath.Join(src, "cache"), 0755)
+	os.MkdirAll(filepath.Join(src, "shots"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "report.txt"), []byte("report"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "shots/1.jpg"), []byte("jpg"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "cache/tmp.bin"), []byte("bin"), 0644)
+	os.Symlink("report.txt", filepath.Join(src, "latest"))
+
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, writeArchive(buf, "tar.gz", src, ArchiveFilter{Excludes: []string{"cache"}}))
+	gr, err := gzip.NewReader(buf)
+	assert.Nil(t, err)
+	tr := tar.NewReader(gr)
+	names := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		data, _ := ioutil.ReadAll(tr)
+		names[header.Name] = string(data) + header.Linkname
+	}
+	assert.Equal(t, map[string]string{
+		"results/":            "",
+		"results/report.txt":  "report",
+		"results/shots/":      "",
+		"results/shots/1.jpg": "jpg",
+		"results/latest":      "report.txt",
+	}, names)
+
+	buf.Reset()
+	assert.Nil(t, writeArchive(buf, "zip", src, ArchiveFilter{Includes: []string{"*.jpg", "*.txt"}}))
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	var zipNames []string
+	for _, f := range zr.File {
+		zipNames = append(zipNames, f.Name)
+	}
+	assert.Equal(t, []string{"results/report.txt", "results/shots/1.jpg"}, zipNames)
+
+	assert.NotNil(t, writeArchive(buf, "rar", src, ArchiveFilter{}))
+}
+
+func TestCopyTarEntry(t *testing.T) {
+	for content, expect := range map[string]string{
+		"grown log": "grown ", // appended after stat
+		"log":       "log\x00\x00\x00",
+		"shrunk":    "shrunk",
+	} {
+		buf := bytes.NewBuffer(nil)
+		tw := tar.NewWriter(buf)
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "a.log", Mode: 0644, Size: 6}))
+		assert.Nil(t, copyTarEntry(tw, strings.NewReader(content), 6))
+		assert.Nil(t, tw.Close())
+
+		tr := tar.NewReader(buf)
+		_, err := tr.Next()
+		assert.Nil(t, err)
+		data, err := ioutil.ReadAll(tr)
+		assert.Nil(t, err)
+		assert.Equal(t, expect, string(data))
+	}
+}
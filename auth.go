@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	authTokens     []string // set by: server --token
+	authTokenFile  string   // set by: server --token-file
+	authAllowPaths []string // set by: server --auth-allow
+
+	// paths can be accessed without token, "METHOD path" allows only the method
+	defaultAuthAllowPaths = []string{"/", "/version"}
+	// /info/battery and /info/rotation are posted by the uiautomator apk running on device, which has no token.
+	// Requests from other hosts need a token with shell scope, because the rotation is used to map touch
+	// positions and rotate screenshots.
+	loopbackAuthAllowPaths = []string{"/info/battery", "/info/rotation"}
+
+	authenticator *Authenticator // nil means no authentication
+)
+
+// Authenticator check token of every request, token is read from
+//   - Header: Authorization: Bearer <token>
+//   - Query: ?token=<token>, for clients can not set headers, eg: browser websocket
+//
+// Token is written as "<token>:<scope>,<scope>" in command line and "<token> <scope>,<scope>"
+// in token file, admin scope is granted when no scope is given.
+// Token file contains one token per line, empty lines and lines start with # are ignored.
+// The file is reloaded when modified.
+type Authenticator struct {
+	mu          sync.Mutex
+	tokens      []credential
+	fileTokens  []credential
+	tokenFile   string
+	fileModTime time.Time
+	allowPaths  []string
+}
+
+func NewAuthenticator(tokens []string, tokenFile string, allowPaths []string) (*Authenticator, error) {
+	a := &Authenticator{
+		tokenFile:  tokenFile,
+		allowPaths: append(append([]string{}, defaultAuthAllowPaths...), allowPaths...),
+	}
+	for _, token := range tokens {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+		cred := credential{token: token}
+		if i := strings.LastIndex(token, ":"); i > 0 {
+			scopes, err := parseScopes(token[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			cred = credential{token: token[:i], scopes: scopes}
+		}
+		a.tokens = append(a.tokens, cred.withDefaultScope())
+	}
+	if tokenFile != "" {
+		if err := a.reloadTokenFile(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+type credential struct {
+	token  string
+	scopes ScopeSet
+}
+
+func (c credential) withDefaultScope() credential {
+	if len(c.scopes) == 0 {
+		c.scopes = ScopeSet{ScopeAdmin: true}
+	}
+	return c
+}
+
+func readTokenFile(filename string) (tokens []credential, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		cred := credential{token: fields[0]}
+		if len(fields) > 1 {
+			if cred.scopes, err = parseScopes(strings.Join(fields[1:], ",")); err != nil {
+				return nil, err
+			}
+		}
+		tokens = append(tokens, cred.withDefaultScope())
+	}
+	return tokens, scanner.Err()
+}
+
+// reloadTokenFile read token file again when it is modified
+func (a *Authenticator) reloadTokenFile() error {
+	finfo, err := os.Stat(a.tokenFile)
+	if err != nil {
+		return errors.Wrap(err, "token file")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if finfo.ModTime().Equal(a.fileModTime) {
+		return nil
+	}
+	tokens, err := readTokenFile(a.tokenFile)
+	if err != nil {
+		return errors.Wrap(err, "token file")
+	}
+	a.fileTokens = tokens
+	a.fileModTime = finfo.ModTime()
+	log.Printf("load %d tokens from %s", len(tokens), a.tokenFile)
+	return nil
+}
+
+// Enabled return false when no token configured
+func (a *Authenticator) Enabled() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.tokens)+len(a.fileTokens) > 0 || a.tokenFile != ""
+}
+
+// AnyToken return a configured admin token, used to call the running server, eg: server --stop
+func (a *Authenticator) AnyToken() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, cred := range append(append([]credential{}, a.tokens...), a.fileTokens...) {
+		if cred.scopes.Has(ScopeAdmin) {
+			return cred.token
+		}
+	}
+	return ""
+}
+
+// allowed report whether the request can be served without token
+func (a *Authenticator) allowed(r *http.Request) bool {
+	if matchAllowPaths(a.allowPaths, r.Method, r.URL.Path) {
+		return true
+	}
+	return isLoopbackRemote(r.RemoteAddr) && matchAllowPaths(loopbackAuthAllowPaths, r.Method, r.URL.Path)
+}
+
+func matchAllowPaths(allowPaths []string, method, path string) bool {
+	for _, p := range allowPaths {
+		if i := strings.Index(p, " "); i > 0 {
+			if p[:i] != method {
+				continue
+			}
+			p = p[i+1:]
+		}
+		if path == p || (strings.HasSuffix(p, "/") && p != "/" && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLoopbackRemote report whether remoteAddr (host:port) is 127.0.0.1 or ::1
+func isLoopbackRemote(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// lookup return scopes of token, false when token is invalid
+func (a *Authenticator) lookup(token string) (ScopeSet, bool) {
+	if token == "" {
+		return nil, false
+	}
+	if a.tokenFile != "" {
+		if err := a.reloadTokenFile(); err != nil {
+			log.Println(err)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var scopes ScopeSet
+	for _, creds := range [][]credential{a.tokens, a.fileTokens} {
+		for _, cred := range creds {
+			if subtle.ConstantTimeCompare([]byte(cred.token), []byte(token)) == 1 {
+				scopes = cred.scopes // no break, keep time constant
+			}
+		}
+	}
+	return scopes, scopes != nil
+}
+
+// requestToken return token in request, the query token is removed
+// so that it will not be passed to handlers or proxied services
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	query := r.URL.Query()
+	token := query.Get("token")
+	if token != "" {
+		query.Del("token")
+		r.URL.RawQuery = query.Encode()
+	}
+	return token
+}
+
+// Wrap return handler which check token before call h, works for websocket too
+// because the upgrade request is a normal http request.
+// Scopes of the token is saved in request context, see: scopesFromContext
+func (a *Authenticator) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if a.allowed(r) || !a.Enabled() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if scopes, ok := a.lookup(token); ok {
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopesContextKey, scopes)))
+			return
+		}
+		log.Printf("unauthorized request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="atx-agent"`)
+		renderJSONError(w, http.StatusUnauthorized, "unauthorized, token required")
+	})
+}
+
+func renderJSONError(w http.ResponseWriter, status int, description string) {
+	js, _ := json.Marshal(map[string]interface{}{
+		"success":     false,
+		"description": description,
+	})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(js)
+}
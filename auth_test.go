@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticator(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "tokens")
+	assert.Nil(t, err)
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("# ci runner\nfile-token\n\n")
+	tokenFile.Close()
+
+	auth, err := NewAuthenticator([]string{"flag-token"}, tokenFile.Name(), []string{"/public/"})
+	assert.Nil(t, err)
+	var query string
+	handler := auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		io.WriteString(w, "ok")
+	}))
+	request := func(method, url string, header string) int {
+		req := httptest.NewRequest(method, url, nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	status := func(url string, header string) int {
+		return request("GET", url, header)
+	}
+
+	assert.Equal(t, 200, status("/version", ""))
+	assert.Equal(t, 200, status("/public/a.txt", ""))
+	assert.Equal(t, 401, request("POST", "/info/rotation", ""))
+	assert.Equal(t, 401, request("POST", "/info/battery", ""))
+	assert.Equal(t, 200, request("POST", "/info/rotation", "Bearer flag-token"))
+	assert.Equal(t, 401, status("/shell", ""))
+	assert.Equal(t, 401, status("/shell", "Bearer wrong"))
+	assert.Equal(t, 200, status("/shell", "Bearer flag-token"))
+	assert.Equal(t, 200, status("/shell?command=ls&token=file-token", ""))
+	assert.Equal(t, "command=ls", query)
+
+	// token file is reloaded when modified
+	assert.Nil(t, ioutil.WriteFile(tokenFile.Name(), []byte("new-token\n"), 0644))
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(tokenFile.Name(), future, future)
+	assert.Equal(t, 401, status("/shell", "Bearer file-token"))
+	assert.Equal(t, 200, status("/shell", "Bearer new-token"))
+
+	noAuth, _ := NewAuthenticator(nil, "", nil)
+	assert.False(t, noAuth.Enabled())
+}
+
+// the uiautomator apk on device post battery and rotation without token
+func TestAuthenticatorApkPosts(t *testing.T) {
+	auth, err := NewAuthenticator([]string{"viewer:read", "runner:shell"}, "", nil)
+	assert.Nil(t, err)
+	m := mux.NewRouter()
+	m.Use(checkScope)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	m.HandleFunc("/info/battery", ok).Methods("POST")
+	m.HandleFunc("/info/rotation", ok)
+	handler := auth.Wrap(m)
+
+	request := func(method, url, remoteAddr, token string) int {
+		req := httptest.NewRequest(method, url, strings.NewReader("1"))
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, 200, request("POST", "/info/rotation", "127.0.0.1:40000", ""))
+	assert.Equal(t, 200, request("POST", "/info/battery", "127.0.0.1:40000", ""))
+	assert.Equal(t, 200, request("POST", "/info/rotation", "[::1]:40000", ""))
+	assert.Equal(t, 401, request("POST", "/info/rotation", "10.0.0.2:40000", ""))
+	assert.Equal(t, 401, request("POST", "/info/battery", "10.0.0.2:40000", ""))
+	assert.Equal(t, 403, request("POST", "/info/rotation", "10.0.0.2:40000", "viewer"))
+	assert.Equal(t, 403, request("POST", "/info/battery", "10.0.0.2:40000", "viewer"))
+	assert.Equal(t, 200, request("GET", "/info/rotation", "10.0.0.2:40000", "viewer"))
+	assert.Equal(t, 200, request("POST", "/info/rotation", "10.0.0.2:40000", "runner"))
+	assert.Equal(t, 200, request("POST", "/info/battery", "10.0.0.2:40000", "runner"))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// finished jobs are kept for a while so client can query the result
+const backgroundJobKeepDuration = 30 * time.Minute
+
+// BackgroundJob is a long running task, eg: install apk, offline download
+type BackgroundJob struct {
+	ID       string
+	Progress *DownloadProgress
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	status     string
+	message    string
+	err        error
+	fields     map[string]interface{}
+	createdAt  time.Time
+	finishedAt time.Time
+}
+
+// Update change status and message of a running job
+func (j *BackgroundJob) Update(status, message string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = status
+	j.message = message
+}
+
+// Set add extra field shown in Info, eg: packageName
+func (j *BackgroundJob) Set(key string, value interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fields[key] = value
+}
+
+// Finish mark job done, err can be nil
+func (j *BackgroundJob) Finish(status, message string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = status
+	j.message = message
+	j.err = err
+	j.finishedAt = time.Now()
+}
+
+func (j *BackgroundJob) Finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finishedAt.IsZero()
+}
+
+func (j *BackgroundJob) Status() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Info return data for json render
+func (j *BackgroundJob) Info() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	data := make(map[string]interface{}, len(j.fields)+4)
+	for key, value := range j.fields {
+		data[key] = value
+	}
+	data["id"] = j.ID
+	data["status"] = j.status
+	data["message"] = j.message
+	if j.err != nil {
+		data["error"] = j.err.Error()
+	}
+	return data
+}
+
+// Background keep track of BackgroundJob, id is increasing number string
+type Background struct {
+	mu   sync.Mutex
+	n    int
+	jobs map[string]*BackgroundJob
+}
+
+func NewBackground() *Background {
+	return &Background{
+		jobs: make(map[string]*BackgroundJob),
+	}
+}
+
+// Go run fn in a new goroutine, fn should call job.Finish before return
+func (b *Background) Go(status, message string, fn func(ctx context.Context, job *BackgroundJob)) *BackgroundJob {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b.mu.Lock()
+	b.removeExpired()
+	b.n++
+	job := &BackgroundJob{
+		ID:        strconv.Itoa(b.n),
+		Progress:  &DownloadProgress{totalSize: -1},
+		ctx:       ctx,
+		cancel:    cancel,
+		status:    status,
+		message:   message,
+		fields:    make(map[string]interface{}),
+		createdAt: time.Now(),
+	}
+	b.jobs[job.ID] = job
+	b.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		fn(ctx, job)
+	}()
+	return job
+}
+
+func (b *Background) Get(id string) (*BackgroundJob, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	job, ok := b.jobs[id]
+	return job, ok
+}
+
+// List return all jobs order by id
+func (b *Background) List() []*BackgroundJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	jobs := make([]*BackgroundJob, 0, len(b.jobs))
+	for _, job := range b.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		a, _ := strconv.Atoi(jobs[i].ID)
+		b, _ := strconv.Atoi(jobs[j].ID)
+		return a < b
+	})
+	return jobs
+}
+
+// Cancel notify job to quit, already finished job can not be canceled
+func (b *Background) Cancel(id string) error {
+	job, ok := b.Get(id)
+	if !ok {
+		return errors.New("job " + strconv.Quote(id) + " not found")
+	}
+	if job.Finished() {
+		return errors.New("job " + strconv.Quote(id) + " already finished")
+	}
+	job.cancel()
+	return nil
+}
+
+// removeExpired should be called with b.mu locked
+func (b *Background) removeExpired() {
+	for id, job := range b.jobs {
+		job.mu.Lock()
+		expired := !job.finishedAt.IsZero() && time.Since(job.finishedAt) > backgroundJobKeepDuration
+		job.mu.Unlock()
+		if expired {
+			delete(b.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the cache is cleared when more files than this are cached
+const checksumCacheMaxFiles = 50000
+
+var checksumCache = NewChecksumCache(checksumCacheMaxFiles)
+
+type checksumCacheEntry struct {
+	size    int64
+	modTime time.Time
+	sums    map[string]string // algorithm -> hex
+}
+
+// ChecksumCache cache checksums by path, size and mtime, so unchanged files are not read again
+type ChecksumCache struct {
+	mu       sync.Mutex
+	maxFiles int
+	entries  map[string]*checksumCacheEntry
+}
+
+func NewChecksumCache(maxFiles int) *ChecksumCache {
+	return &ChecksumCache{
+		maxFiles: maxFiles,
+		entries:  make(map[string]*checksumCacheEntry),
+	}
+}
+
+func (c *ChecksumCache) get(realpath string, finfo os.FileInfo, algorithm string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[realpath]
+	if !ok || entry.size != finfo.Size() || !entry.modTime.Equal(finfo.ModTime()) {
+		return "", false
+	}
+	sum, ok := entry.sums[algorithm]
+	return sum, ok
+}
+
+func (c *ChecksumCache) put(realpath string, finfo os.FileInfo, sums map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[realpath]
+	if !ok || entry.size != finfo.Size() || !entry.modTime.Equal(finfo.ModTime()) {
+		if len(c.entries) >= c.maxFiles {
+			c.entries = make(map[string]*checksumCacheEntry)
+		}
+		entry = &checksumCacheEntry{size: finfo.Size(), modTime: finfo.ModTime(), sums: make(map[string]string)}
+		c.entries[realpath] = entry
+	}
+	for algorithm, sum := range sums {
+		entry.sums[algorithm] = sum
+	}
+}
+
+// Checksums return hex digests of the file for algorithms, read the file once for algorithms not cached.
+// cached is true when the file is not read.
+func (c *ChecksumCache) Checksums(realpath string, algorithms []string) (sums map[string]string, cached bool, err error) {
+	finfo, err := os.Stat(realpath)
+	if err != nil {
+		return nil, false, err
+	}
+	sums = make(map[string]string, len(algorithms))
+	hashes := make(map[string]hash.Hash)
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		if sum, ok := c.get(realpath, finfo, algorithm); ok {
+			sums[algorithm] = sum
+			continue
+		}
+		h, err := newHash(algorithm)
+		if err != nil {
+			return nil, false, err
+		}
+		hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+	if len(hashes) == 0 {
+		return sums, true, nil
+	}
+	f, err := os.Open(realpath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, false, err
+	}
+	computed := make(map[string]string, len(hashes))
+	for algorithm, h := range hashes {
+		computed[algorithm] = hex.EncodeToString(h.Sum(nil))
+		sums[algorithm] = computed[algorithm]
+	}
+	// file changed while reading is not cached
+	if after, err := f.Stat(); err == nil && after.Size() == finfo.Size() && after.ModTime().Equal(finfo.ModTime()) {
+		c.put(realpath, finfo, computed)
+	}
+	return sums, false, nil
+}
+
+// parseAlgorithms parse comma separated algorithms, default sha256
+func parseAlgorithms(s string) ([]string, error) {
+	if s == "" {
+		return []string{"sha256"}, nil
+	}
+	var algorithms []string
+	for _, algorithm := range strings.Split(s, ",") {
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		if _, err := newHash(algorithm); err != nil {
+			return nil, err
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, nil
+}
+
+// checksumRecord is one line of the checksum response, algorithm names are the keys of checksums
+func checksumRecord(lpath, realpath string, algorithms []string) map[string]interface{} {
+	record := map[string]interface{}{"path": lpath}
+	finfo, err := os.Stat(realpath)
+	if err == nil {
+		record["size"] = finfo.Size()
+		record["modTime"] = finfo.ModTime().Unix()
+		var sums map[string]string
+		var cached bool
+		if sums, cached, err = checksumCache.Checksums(realpath, algorithms); err == nil {
+			for algorithm, sum := range sums {
+				record[algorithm] = sum
+			}
+			record["cached"] = cached
+		}
+	}
+	if err != nil {
+		record["error"] = err.Error()
+	}
+	return record
+}
+
+// writeTreeChecksums walk realdir and write checksum of every regular file as a json line.
+// Symlinks are not followed.
+func writeTreeChecksums(w io.Writer, lpath, realdir string, algorithms []string, globs []string) error {
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	return filepath.Walk(realdir, func(p string, finfo os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(realdir, p)
+		rel = filepath.ToSlash(rel)
+		if err != nil {
+			if p == realdir {
+				return err
+			}
+			return enc.Encode(map[string]interface{}{"path": path.Join(lpath, rel), "error": err.Error()})
+		}
+		if !finfo.Mode().IsRegular() || (len(globs) > 0 && !globMatch(globs, rel)) {
+			return nil
+		}
+		if err := enc.Encode(checksumRecord(path.Join(lpath, rel), p, algorithms)); err != nil {
+			return err // client gone
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+}
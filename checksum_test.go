@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumCache(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "checksum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	p := filepath.Join(tmpdir, "a.txt")
+	ioutil.WriteFile(p, []byte("hello"), 0644)
+
+	cache := NewChecksumCache(10)
+	sums, cached, err := cache.Checksums(p, []string{"md5", "sha256"})
+	assert.Nil(t, err)
+	assert.False(t, cached)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", sums["md5"])
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", sums["sha256"])
+
+	sums, cached, _ = cache.Checksums(p, []string{"md5"})
+	assert.True(t, cached)
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", sums["md5"])
+	_, cached, _ = cache.Checksums(p, []string{"sha1"})
+	assert.False(t, cached)
+
+	ioutil.WriteFile(p, []byte("world"), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(p, future, future)
+	sums, cached, _ = cache.Checksums(p, []string{"md5"})
+	assert.False(t, cached)
+	assert.Equal(t, "7d793037a0760186574b0282f2f435e7", sums["md5"])
+
+	_, err = parseAlgorithms("md5,crc32")
+	assert.NotNil(t, err)
+}
+
+func TestWriteTreeChecksums(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "checksum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	os.MkdirAll(filepath.Join(tmpdir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(tmpdir, "a.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpdir, "sub/b.bin"), []byte("world"), 0644)
+	os.Symlink("a.txt", filepath.Join(tmpdir, "link"))
+
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, writeTreeChecksums(buf, "/sdcard/fixtures", tmpdir, []string{"md5"}, nil))
+	dec := json.NewDecoder(buf)
+	var records []map[string]interface{}
+	for dec.More() {
+		var record map[string]interface{}
+		assert.Nil(t, dec.Decode(&record))
+		records = append(records, record)
+	}
+	assert.Len(t, records, 2)
+	assert.Equal(t, "/sdcard/fixtures/a.txt", records[0]["path"])
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", records[0]["md5"])
+	assert.Equal(t, "/sdcard/fixtures/sub/b.bin", records[1]["path"])
+	assert.Equal(t, float64(5), records[1]["size"])
+
+	buf.Reset()
+	assert.Nil(t, writeTreeChecksums(buf, "/sdcard/fixtures", tmpdir, []string{"md5"}, []string{"*.bin"}))
+	assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	downloadStatusDownloading = "downloading"
+	downloadStatusVerifying   = "verifying"
+	downloadStatusSuccess     = "success"
+	downloadStatusFailure     = "failure"
+	downloadStatusCanceled    = "canceled"
+)
+
+// DownloadProgress counts bytes written through it, safe for concurrent read
+type DownloadProgress struct {
+	mu         sync.Mutex
+	totalSize  int64
+	copiedSize int64
+}
+
+func (p *DownloadProgress) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	p.copiedSize += int64(len(data))
+	p.mu.Unlock()
+	return len(data), nil
+}
+
+// Reset set totalSize and copiedSize, copiedSize is not zero when download resumed
+func (p *DownloadProgress) Reset(totalSize, copiedSize int64) {
+	p.mu.Lock()
+	p.totalSize = totalSize
+	p.copiedSize = copiedSize
+	p.mu.Unlock()
+}
+
+// Sizes return (totalSize, copiedSize), totalSize is -1 when unknown
+func (p *DownloadProgress) Sizes() (total int64, copied int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.totalSize, p.copiedSize
+}
+
+func (p *DownloadProgress) MarshalJSON() ([]byte, error) {
+	total, copied := p.Sizes()
+	return json.Marshal(map[string]int64{
+		"totalSize":  total,
+		"copiedSize": copied,
+	})
+}
+
+// downloadFile save url content to dst, stop when ctx canceled
+func downloadFile(ctx context.Context, url string, dst string, progress *DownloadProgress) error {
+	return fetchToFile(ctx, url, dst, progress, false)
+}
+
+// fetchToFile is like downloadFile, when resume is true and dst already exists,
+// only the missing part is requested with http header Range
+func fetchToFile(ctx context.Context, url string, dst string, progress *DownloadProgress, resume bool) error {
+	var offset int64
+	if resume {
+		if finfo, err := os.Stat(dst); err == nil {
+			offset = finfo.Size()
+		}
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		offset = 0 // server does not support range
+		progress.Reset(resp.ContentLength, 0)
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start, end, total int64 = -1, 0, -1
+		fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		if start != offset {
+			return fmt.Errorf("download %s: unexpected Content-Range %q", url, resp.Header.Get("Content-Range"))
+		}
+		flag = os.O_WRONLY | os.O_APPEND
+		if total < 0 && resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+		progress.Reset(total, offset)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		var total int64 = -1
+		fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &total)
+		if total == offset { // already downloaded
+			progress.Reset(total, offset)
+			return nil
+		}
+		// local file is larger than remote, download again
+		return fetchToFile(ctx, url, dst, progress, false)
+	default:
+		return fmt.Errorf("download %s: http status %s", url, resp.Status)
+	}
+
+	fd, err := os.OpenFile(dst, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = io.Copy(io.MultiWriter(fd, progress), resp.Body)
+	return err
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToLower(algorithm) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	}
+	return nil, errors.New("unsupported hash algorithm: " + algorithm)
+}
+
+// parseChecksum accept format <algorithm>:<hex>, eg: sha256:2c26b46b...
+// algorithm can be omitted, and is guessed from hex length
+func parseChecksum(checksum string) (algorithm string, hexsum string, err error) {
+	if idx := strings.Index(checksum, ":"); idx != -1 {
+		algorithm, hexsum = checksum[:idx], checksum[idx+1:]
+	} else {
+		hexsum = checksum
+		switch len(hexsum) {
+		case md5.Size * 2:
+			algorithm = "md5"
+		case sha1.Size * 2:
+			algorithm = "sha1"
+		case sha256.Size * 2:
+			algorithm = "sha256"
+		default:
+			return "", "", errors.New("unable to guess checksum algorithm: " + checksum)
+		}
+	}
+	if _, err = newHash(algorithm); err != nil {
+		return
+	}
+	hexsum = strings.ToLower(hexsum)
+	if _, err = hex.DecodeString(hexsum); err != nil {
+		err = errors.Wrap(err, "checksum")
+	}
+	return
+}
+
+func fileHexDigest(filename string, algorithm string) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	fd, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func verifyChecksum(filename string, checksum string) error {
+	algorithm, expect, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	actual, err := fileHexDigest(filename, algorithm)
+	if err != nil {
+		return err
+	}
+	if actual != expect {
+		return fmt.Errorf("%s checksum mismatch, expect %s but got %s", algorithm, expect, actual)
+	}
+	return nil
+}
+
+// DownloadOptions for DownloadManager.Download
+type DownloadOptions struct {
+	URL      string
+	Filepath string
+	Mode     os.FileMode // 0 means keep default
+	Checksum string      // optional, format <algorithm>:<hex>
+}
+
+// DownloadManager download file to device in background.
+// Content is saved to <filepath>.download first, so the download
+// can be resumed after failure or cancel.
+type DownloadManager struct {
+	*Background
+	mu sync.Mutex // check and register filepath of a new download at once
+}
+
+func NewDownloadManager() *DownloadManager {
+	return &DownloadManager{
+		Background: NewBackground(),
+	}
+}
+
+// Download start a background download job and return its id
+func (m *DownloadManager) Download(opts DownloadOptions) (string, error) {
+	if opts.URL == "" {
+		return "", errors.New("url is required")
+	}
+	if opts.Filepath == "" {
+		return "", errors.New("filepath is required")
+	}
+	if opts.Checksum != "" {
+		if _, _, err := parseChecksum(opts.Checksum); err != nil {
+			return "", err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, job := range m.List() {
+		if !job.Finished() && job.Info()["filepath"] == opts.Filepath {
+			return "", errors.New("already downloading to " + opts.Filepath + ", id: " + job.ID)
+		}
+	}
+	job := m.Go(downloadStatusDownloading, "downloading", func(ctx context.Context, job *BackgroundJob) {
+		downloadInBackground(ctx, job, opts)
+	})
+	job.Set("url", opts.URL)
+	job.Set("filepath", opts.Filepath)
+	return job.ID, nil
+}
+
+// DownloadInfo is like job.Info, but with progress
+func DownloadInfo(job *BackgroundJob) map[string]interface{} {
+	data := job.Info()
+	data["progress"] = job.Progress
+	return data
+}
+
+func downloadInBackground(ctx context.Context, job *BackgroundJob, opts DownloadOptions) {
+	if err := os.MkdirAll(filepath.Dir(opts.Filepath), 0755); err != nil {
+		job.Finish(downloadStatusFailure, "mkdir failed", err)
+		return
+	}
+	partial := opts.Filepath + ".download"
+	log.Printf("download[%s] %s to %s", job.ID, opts.URL, partial)
+	if err := fetchToFile(ctx, opts.URL, partial, job.Progress, true); err != nil {
+		if ctx.Err() != nil {
+			job.Finish(downloadStatusCanceled, "canceled", nil)
+		} else {
+			job.Finish(downloadStatusFailure, "download failed", err)
+		}
+		return
+	}
+	if opts.Checksum != "" {
+		job.Update(downloadStatusVerifying, "verifying")
+		if err := verifyChecksum(partial, opts.Checksum); err != nil {
+			os.Remove(partial) // corrupted, do not resume from it
+			job.Finish(downloadStatusFailure, "checksum verify failed", err)
+			return
+		}
+	}
+	if opts.Mode != 0 {
+		if err := os.Chmod(partial, opts.Mode); err != nil {
+			job.Finish(downloadStatusFailure, "chmod failed", err)
+			return
+		}
+	}
+	if err := os.Rename(partial, opts.Filepath); err != nil {
+		job.Finish(downloadStatusFailure, "rename failed", err)
+		return
+	}
+	log.Printf("download[%s] saved to %s", job.ID, opts.Filepath)
+	job.Finish(downloadStatusSuccess, "downloaded", nil)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchToFileResume(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.bin", time.Now(), bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "download")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dst := filepath.Join(tmpDir, "data.bin")
+
+	// simulate a broken download
+	assert.Nil(t, ioutil.WriteFile(dst, content[:300], 0644))
+	progress := &DownloadProgress{}
+	assert.Nil(t, fetchToFile(context.Background(), ts.URL, dst, progress, true))
+	data, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, content, data)
+	total, copied := progress.Sizes()
+	assert.Equal(t, int64(len(content)), total)
+	assert.Equal(t, int64(len(content)), copied)
+
+	// already finished
+	assert.Nil(t, fetchToFile(context.Background(), ts.URL, dst, progress, true))
+	data, _ = ioutil.ReadFile(dst)
+	assert.Equal(t, content, data)
+}
+
+func TestParseChecksum(t *testing.T) {
+	algorithm, hexsum, err := parseChecksum("d41d8cd98f00b204e9800998ecf8427e")
+	assert.Nil(t, err)
+	assert.Equal(t, "md5", algorithm)
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", hexsum)
+
+	algorithm, _, err = parseChecksum("SHA256:E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855")
+	assert.Nil(t, err)
+	assert.Equal(t, "SHA256", algorithm)
+
+	_, _, err = parseChecksum("crc32:00000000")
+	assert.NotNil(t, err)
+	_, _, err = parseChecksum("abc")
+	assert.NotNil(t, err)
+}
+
+func TestDownloadSameFilepath(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+	tmpDir, err := ioutil.TempDir("", "download")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	dst := filepath.Join(tmpDir, "data.bin")
+
+	m := NewDownloadManager()
+	ids := make(chan string, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if id, err := m.Download(DownloadOptions{URL: ts.URL, Filepath: dst}); err == nil {
+				ids <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	assert.Len(t, ids, 1, "only one download to the same filepath")
+	close(release)
+
+	job, _ := m.Get(<-ids)
+	for i := 0; i < 50 && !job.Finished(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, downloadStatusSuccess, job.Status())
+	data, _ := ioutil.ReadFile(dst)
+	assert.Equal(t, "hello", string(data))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive formats can be extracted by /upload
+const (
+	formatZip    = "zip"
+	formatTar    = "tar"
+	formatTarGz  = "tar.gz"
+	formatTarZst = "tar.zst"
+)
+
+// detectArchiveFormat detect format by the magic bytes of the first 512 bytes, empty when unknown
+func detectArchiveFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return formatZip
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return formatTarGz
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return formatTarZst
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return formatTar
+	}
+	return ""
+}
+
+func normalizeArchiveFormat(format string) (string, error) {
+	switch format {
+	case formatZip, formatTar, formatTarGz, formatTarZst:
+		return format, nil
+	case "tgz":
+		return formatTarGz, nil
+	case "tzst":
+		return formatTarZst, nil
+	}
+	return "", fmt.Errorf("unsupported archive format: %q, should be one of zip, tar, tar.gz, tar.zst", format)
+}
+
+// extractArchive extract archive into dest, format is detected when empty.
+// return the paths of files, directories and links written
+func extractArchive(ra io.ReaderAt, size int64, format, dest string) (string, []string, error) {
+	if format == "" {
+		head := make([]byte, 512)
+		n, _ := ra.ReadAt(head, 0)
+		if format = detectArchiveFormat(head[:n]); format == "" {
+			return "", nil, fmt.Errorf("unknown archive format, should be one of zip, tar, tar.gz, tar.zst")
+		}
+	} else {
+		var err error
+		if format, err = normalizeArchiveFormat(format); err != nil {
+			return "", nil, err
+		}
+	}
+	rd := io.NewSectionReader(ra, 0, size)
+	var files []string
+	var err error
+	switch format {
+	case formatZip:
+		files, err = extractZip(ra, size, dest)
+	case formatTar:
+		files, err = extractTar(rd, dest)
+	case formatTarGz:
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(rd); err == nil {
+			files, err = extractTar(gr, dest)
+			gr.Close()
+		}
+	case formatTarZst:
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(rd); err == nil {
+			files, err = extractTar(zr, dest)
+			zr.Close()
+		}
+	}
+	return format, files, err
+}
+
+// safeJoin join the archive entry name to dest. Error when the result is outside dest,
+// either by absolute path, .. or a symlink (zip-slip).
+func safeJoin(dest, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || strings.HasPrefix(name, string(filepath.Separator)) || filepath.VolumeName(name) != "" {
+		return "", &SandboxError{Path: name, Reason: sandboxZipSlip}
+	}
+	target := filepath.Join(dest, name)
+	if !pathWithin(target, filepath.Clean(dest)) {
+		return "", &SandboxError{Path: name, Reason: sandboxZipSlip}
+	}
+	realDest, err := resolveSymlinks(filepath.Clean(dest))
+	if err != nil {
+		return "", err
+	}
+	realTarget, err := resolveSymlinks(target)
+	if err != nil {
+		return "", err
+	}
+	if !pathWithin(realTarget, realDest) {
+		return "", &SandboxError{Path: name, Reason: sandboxZipSlip}
+	}
+	return target, nil
+}
+
+// writeEntry write content of an archive entry to target
+func writeEntry(target string, rd io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if mode.Perm() == 0 {
+		mode = 0644
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rd); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(target, mode.Perm()) // not affected by umask
+}
+
+// writeSymlink create symlink at target, the link must point inside dest
+func writeSymlink(dest, target, linkname string) error {
+	resolved := linkname
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(filepath.Dir(target), linkname)
+	}
+	if filepath.IsAbs(linkname) || !pathWithin(filepath.Clean(resolved), filepath.Clean(dest)) {
+		return &SandboxError{Path: linkname, Reason: sandboxZipSlip}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	os.Remove(target)
+	return os.Symlink(linkname, target)
+}
+
+// dirModes set mode of directories after all files are extracted,
+// so that a read only directory does not prevent writing files inside
+type dirModes map[string]os.FileMode
+
+func (dm dirModes) mkdir(target string, mode os.FileMode) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if mode.Perm() != 0 {
+		dm[target] = mode.Perm()
+	}
+	return nil
+}
+
+func (dm dirModes) apply() error {
+	for target, mode := range dm {
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractZip extract zip into dest
+func extractZip(ra io.ReaderAt, size int64, dest string) ([]string, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(zr.File))
+	dirs := make(dirModes)
+	for _, f := range zr.File {
+		target, err := safeJoin(dest, f.Name)
+		if err != nil {
+			return files, err
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = dirs.mkdir(target, mode)
+		case mode&os.ModeSymlink != 0:
+			var rc io.ReadCloser
+			if rc, err = f.Open(); err == nil {
+				var linkname []byte
+				linkname, err = ioutil.ReadAll(io.LimitReader(rc, 4096))
+				rc.Close()
+				if err == nil {
+					err = writeSymlink(dest, target, string(linkname))
+				}
+			}
+		default:
+			var rc io.ReadCloser
+			if rc, err = f.Open(); err == nil {
+				err = writeEntry(target, rc, mode)
+				rc.Close()
+			}
+		}
+		if err != nil {
+			return files, err
+		}
+		files = append(files, target)
+	}
+	return files, dirs.apply()
+}
+
+// extractTar extract tar stream into dest, modes and symlinks are preserved
+func extractTar(rd io.Reader, dest string) ([]string, error) {
+	tr := tar.NewReader(rd)
+	files := make([]string, 0, 16)
+	dirs := make(dirModes)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return files, err
+		}
+		target, err := safeJoin(dest, header.Name)
+		if err != nil {
+			return files, err
+		}
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = dirs.mkdir(target, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeEntry(target, tr, mode)
+		case tar.TypeSymlink:
+			err = writeSymlink(dest, target, header.Linkname)
+		case tar.TypeLink:
+			var source string
+			if source, err = safeJoin(dest, header.Linkname); err == nil {
+				os.Remove(target)
+				err = os.Link(source, target)
+			}
+		default:
+			log.Printf("extract skip %s, unsupported type %c", header.Name, header.Typeflag)
+			continue
+		}
+		if err != nil {
+			return files, err
+		}
+		if header.Typeflag != tar.TypeSymlink && header.Typeflag != tar.TypeDir {
+			os.Chtimes(target, header.ModTime, header.ModTime)
+		}
+		files = append(files, target)
+	}
+	return files, dirs.apply()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestTar(t *testing.T, w io.Writer) {
+	tw := tar.NewWriter(w)
+	mtime := time.Unix(1500000000, 0)
+	entries := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "bin/run.sh", Typeflag: tar.TypeReg, Mode: 0750, Size: 9, ModTime: mtime},
+		{Name: "bin/run", Typeflag: tar.TypeSymlink, Linkname: "run.sh", Mode: 0777, ModTime: mtime},
+		{Name: "readonly/", Typeflag: tar.TypeDir, Mode: 0555, ModTime: mtime},
+		{Name: "readonly/a.txt", Typeflag: tar.TypeReg, Mode: 0444, Size: 1, ModTime: mtime},
+	}
+	for _, header := range entries {
+		assert.Nil(t, tw.WriteHeader(header))
+		if header.Size > 0 {
+			tw.Write([]byte("echo hello"[:header.Size]))
+		}
+	}
+	assert.Nil(t, tw.Close())
+}
+
+func TestExtractArchive(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "extract")
+	assert.Nil(t, err)
+	defer func() {
+		filepath.Walk(tmpdir, func(p string, info os.FileInfo, err error) error {
+			os.Chmod(p, 0755)
+			return nil
+		})
+		os.RemoveAll(tmpdir)
+	}()
+
+	tarBuf := bytes.NewBuffer(nil)
+	makeTestTar(t, tarBuf)
+	gzBuf := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(gzBuf)
+	gw.Write(tarBuf.Bytes())
+	gw.Close()
+	zstBuf := bytes.NewBuffer(nil)
+	zw, _ := zstd.NewWriter(zstBuf)
+	zw.Write(tarBuf.Bytes())
+	zw.Close()
+
+	for name, data := range map[string][]byte{"tar": tarBuf.Bytes(), "tar.gz": gzBuf.Bytes(), "tar.zst": zstBuf.Bytes()} {
+		dest := filepath.Join(tmpdir, name)
+		format, files, err := extractArchive(bytes.NewReader(data), int64(len(data)), "", dest)
+		assert.Nil(t, err, name)
+		assert.Equal(t, name, format)
+		assert.Len(t, files, 5)
+
+		finfo, err := os.Stat(filepath.Join(dest, "bin/run.sh"))
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0750), finfo.Mode().Perm())
+		assert.Equal(t, int64(1500000000), finfo.ModTime().Unix())
+		link, _ := os.Readlink(filepath.Join(dest, "bin/run"))
+		assert.Equal(t, "run.sh", link)
+		finfo, _ = os.Stat(filepath.Join(dest, "readonly"))
+		assert.Equal(t, os.FileMode(0555), finfo.Mode().Perm())
+	}
+
+	_, _, err = extractArchive(bytes.NewReader([]byte("plain text")), 10, "", tmpdir)
+	assert.NotNil(t, err)
+	_, _, err = extractArchive(bytes.NewReader(tarBuf.Bytes()), int64(tarBuf.Len()), "rar", tmpdir)
+	assert.NotNil(t, err)
+}
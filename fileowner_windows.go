@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+func fileOwner(finfo os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
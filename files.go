@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errDirNotEmpty   = errors.New("directory not empty, set recursive=true to delete")
+	errCopyIntoSelf  = errors.New("can not copy or move a directory into itself")
+	errUnsupportFile = errors.New("only regular file, directory and symlink are supported")
+)
+
+// renderFileError render error of file operations as json, sandbox errors as 403
+func renderFileError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*SandboxError); ok {
+		renderPathError(w, err, http.StatusForbidden)
+		return
+	}
+	status := http.StatusInternalServerError
+	switch {
+	case os.IsNotExist(err):
+		status = http.StatusNotFound
+	case os.IsExist(err), err == errDirNotEmpty:
+		status = http.StatusConflict
+	case os.IsPermission(err):
+		status = http.StatusForbidden
+	case err == errCopyIntoSelf, err == errUnsupportFile:
+		status = http.StatusBadRequest
+	case errors.Cause(err) == errSyncChecksum:
+		status = http.StatusUnprocessableEntity
+	}
+	renderJSONError(w, status, err.Error())
+}
+
+func parseFileMode(s string, defaultMode os.FileMode) (os.FileMode, error) {
+	if s == "" {
+		return defaultMode, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid mode: %q, should be octal like 0644", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseMtime parse unix timestamp in seconds or RFC3339 time, empty means now
+func parseMtime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	if sec, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(sec*1e9)), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func removePath(realpath string, recursive bool) error {
+	finfo, err := os.Lstat(realpath)
+	if err != nil {
+		return err
+	}
+	if !finfo.IsDir() {
+		return os.Remove(realpath)
+	}
+	if recursive {
+		return os.RemoveAll(realpath)
+	}
+	f, err := os.Open(realpath)
+	if err != nil {
+		return err
+	}
+	names, _ := f.Readdirnames(1)
+	f.Close()
+	if len(names) > 0 {
+		return errDirNotEmpty
+	}
+	return os.Remove(realpath)
+}
+
+// copyPath copy file or directory recursively, symlinks are copied as they are
+func copyPath(src, dst string) error {
+	finfo, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case finfo.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	case finfo.IsDir():
+		if err := os.Mkdir(dst, finfo.Mode().Perm()|0700); err != nil {
+			return err
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := copyPath(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+				return err
+			}
+		}
+		return os.Chmod(dst, finfo.Mode().Perm())
+	case finfo.Mode().IsRegular():
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, finfo.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	default:
+		return errUnsupportFile
+	}
+}
+
+// transferPath move or copy src to dst. An existing dst is replaced only when overwrite is true,
+// and only after src is moved or copied to a temporary sibling, so a failed transfer keeps dst as it was.
+// Rename fallback to copy and remove when they are on different filesystems, eg: /sdcard and /data/local/tmp
+func transferPath(src, dst string, move, overwrite bool) error {
+	// dst inside src, or src inside dst which is removed when overwrite
+	if dst == src || pathWithin(dst, src) || pathWithin(src, dst) {
+		return errCopyIntoSelf
+	}
+	_, err := os.Lstat(dst)
+	exists := err == nil
+	if exists && !overwrite {
+		return &os.PathError{Op: "write", Path: dst, Err: os.ErrExist}
+	}
+	target := dst
+	if exists {
+		target = filepath.Join(filepath.Dir(dst), ".atx-transfer-"+randomID())
+	}
+	crossDevice := false
+	if move {
+		err = os.Rename(src, target)
+		if lerr, ok := err.(*os.LinkError); ok && lerr.Err == syscall.EXDEV {
+			crossDevice = true
+			err = copyPath(src, target)
+		}
+	} else {
+		err = copyPath(src, target)
+	}
+	undo := func() {
+		if move && !crossDevice {
+			os.Rename(target, src)
+		} else {
+			os.RemoveAll(target)
+		}
+	}
+	if err != nil {
+		if !move || crossDevice {
+			os.RemoveAll(target) // partial copy
+		}
+		return err
+	}
+	if exists {
+		backup := filepath.Join(filepath.Dir(dst), ".atx-transfer-"+randomID())
+		if err := os.Rename(dst, backup); err != nil {
+			undo()
+			return err
+		}
+		if err := os.Rename(target, dst); err != nil {
+			os.Rename(backup, dst)
+			undo()
+			return err
+		}
+		os.RemoveAll(backup)
+	}
+	if crossDevice {
+		return os.RemoveAll(src)
+	}
+	return nil
+}
+
+func chmodPath(realpath string, mode os.FileMode, recursive bool) error {
+	if !recursive {
+		return os.Chmod(realpath, mode)
+	}
+	return filepath.Walk(realpath, func(p string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if finfo.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chmod(p, mode)
+	})
+}
+
+// touchPath update mtime of file, an empty file is created when not exists and create is true
+func touchPath(realpath string, mtime time.Time, create bool) error {
+	if _, err := os.Stat(realpath); os.IsNotExist(err) && create {
+		f, err := os.OpenFile(realpath, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return os.Chtimes(realpath, mtime, mtime)
+}
+
+func formBool(r *http.Request, name string) bool {
+	v, _ := strconv.ParseBool(strings.TrimSpace(r.FormValue(name)))
+	return v
+}
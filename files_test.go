@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilesAPI(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "files")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	tmpdir, _ = filepath.EvalSymlinks(tmpdir)
+	root := filepath.Join(tmpdir, "root")
+	os.MkdirAll(root, 0755)
+
+	oldSandbox := fsSandbox
+	defer func() { fsSandbox = oldSandbox }()
+	fsSandbox, _ = NewSandbox([]string{root})
+
+	router := NewServer().router
+	request := func(method, lpath string, form url.Values) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, "/files"+lpath, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		var data map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &data)
+		return rec.Code, data
+	}
+
+	code, data := request("POST", root+"/a/b", url.Values{"action": {"mkdir"}, "parents": {"true"}})
+	assert.Equal(t, 200, code)
+	assert.Equal(t, true, data["isDirectory"])
+	assert.Equal(t, root+"/a/b", data["path"])
+
+	code, data = request("PATCH", root+"/a/b/c.txt", url.Values{"mtime": {"1500000000"}})
+	assert.Equal(t, 200, code)
+	assert.Equal(t, float64(1500000000), data["modTime"])
+
+	code, _ = request("POST", root+"/a", url.Values{"action": {"copy"}, "dst": {root + "/a2"}})
+	assert.Equal(t, 200, code)
+	assert.True(t, fileExists(root+"/a2/b/c.txt"))
+	code, _ = request("POST", root+"/a", url.Values{"action": {"copy"}, "dst": {root + "/a/b/a"}})
+	assert.Equal(t, 400, code)
+	code, _ = request("POST", root+"/a", url.Values{"action": {"move"}, "dst": {root + "/a2"}})
+	assert.Equal(t, 409, code)
+	// dst is the parent of src, which would be removed before the copy
+	code, _ = request("POST", root+"/a/b", url.Values{"action": {"copy"}, "dst": {root + "/a"}, "overwrite": {"true"}})
+	assert.Equal(t, 400, code)
+	code, _ = request("POST", root+"/a/b", url.Values{"action": {"move"}, "dst": {root + "/a"}, "overwrite": {"true"}})
+	assert.Equal(t, 400, code)
+	assert.True(t, fileExists(root+"/a/b/c.txt"))
+	code, data = request("POST", root+"/a", url.Values{"action": {"move"}, "dst": {root + "/a2"}, "overwrite": {"true"}})
+	assert.Equal(t, 200, code)
+	assert.Equal(t, root+"/a2", data["path"])
+	assert.False(t, fileExists(root+"/a"))
+
+	code, data = request("POST", root+"/a2/b/c.txt", url.Values{"action": {"chmod"}, "mode": {"0600"}})
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "0600", data["mode"])
+
+	code, data = request("POST", root+"/a2", url.Values{"action": {"move"}, "dst": {tmpdir + "/escaped"}})
+	assert.Equal(t, 403, code)
+	assert.Equal(t, sandboxOutsideRoots, data["reason"])
+
+	code, _ = request("DELETE", root+"/a2", nil)
+	assert.Equal(t, 409, code)
+	code, _ = request("DELETE", root, url.Values{"recursive": {"true"}})
+	assert.Equal(t, 403, code)
+	code, _ = request("DELETE", root+"/a2?recursive=true", nil)
+	assert.Equal(t, 200, code)
+	assert.False(t, fileExists(root+"/a2"))
+	code, _ = request("DELETE", root+"/a2", nil)
+	assert.Equal(t, 404, code)
+}
+
+func TestFilesCORSPreflight(t *testing.T) {
+	handler := NewServer().httpServer.Handler
+	for _, method := range []string{"PATCH", "HEAD"} {
+		req := httptest.NewRequest("OPTIONS", "/files/sdcard/a.txt", nil)
+		req.Header.Set("Origin", "http://example.com")
+		req.Header.Set("Access-Control-Request-Method", method)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"), method)
+		assert.Equal(t, method, rec.Header().Get("Access-Control-Allow-Methods"))
+	}
+}
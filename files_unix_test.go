@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferPathKeepDestination(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "transfer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	src := filepath.Join(tmpdir, "src")
+	dst := filepath.Join(tmpdir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(dst, 0755)
+	ioutil.WriteFile(filepath.Join(dst, "old.txt"), []byte("old"), 0644)
+	// a fifo can not be copied, so the copy fails in the middle
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("new"), 0644)
+	if err := syscall.Mkfifo(filepath.Join(src, "z.fifo"), 0644); err != nil {
+		t.Skip("mkfifo not supported:", err)
+	}
+
+	err = transferPath(src, dst, false, true)
+	assert.Equal(t, errUnsupportFile, err)
+	data, _ := ioutil.ReadFile(filepath.Join(dst, "old.txt"))
+	assert.Equal(t, "old", string(data))
+	names, _ := filepath.Glob(filepath.Join(tmpdir, ".atx-transfer-*"))
+	assert.Len(t, names, 0)
+
+	os.Remove(filepath.Join(src, "z.fifo"))
+	assert.NoError(t, transferPath(src, dst, true, true))
+	assert.False(t, fileExists(src))
+	assert.False(t, fileExists(filepath.Join(dst, "old.txt")))
+	data, _ = ioutil.ReadFile(filepath.Join(dst, "a.txt"))
+	assert.Equal(t, "new", string(data))
+	names, _ = filepath.Glob(filepath.Join(tmpdir, ".atx-transfer-*"))
+	assert.Len(t, names, 0)
+}
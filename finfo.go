@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const finfoMaxDepth = 32
+
+// FileEntry is the file information returned by /finfo and /files
+type FileEntry struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	IsDirectory bool   `json:"isDirectory"`
+	Size        int64  `json:"size"`
+	Mode        string `json:"mode"`
+	ModTime     int64  `json:"modTime"` // unix timestamp in seconds
+	Uid         *int   `json:"uid,omitempty"`
+	Gid         *int   `json:"gid,omitempty"`
+	IsSymlink   bool   `json:"isSymlink,omitempty"`
+	LinkTarget  string `json:"linkTarget,omitempty"`
+	LinkBroken  bool   `json:"linkBroken,omitempty"`
+}
+
+// newFileEntry lstat realpath, and report it as lpath.
+// For symlink, isDirectory, size and mtime are of the file it points to.
+func newFileEntry(lpath, realpath string) (*FileEntry, error) {
+	finfo, err := os.Lstat(realpath)
+	if err != nil {
+		return nil, err
+	}
+	entry := &FileEntry{
+		Name: filepath.Base(lpath),
+		Path: lpath,
+	}
+	if finfo.Mode()&os.ModeSymlink != 0 {
+		entry.IsSymlink = true
+		entry.LinkTarget, _ = os.Readlink(realpath)
+		if target, err := os.Stat(realpath); err == nil {
+			finfo = target
+		} else {
+			entry.LinkBroken = true
+		}
+	}
+	entry.IsDirectory = finfo.IsDir()
+	entry.Size = finfo.Size()
+	entry.Mode = fmt.Sprintf("%04o", finfo.Mode().Perm())
+	entry.ModTime = finfo.ModTime().Unix()
+	if uid, gid, ok := fileOwner(finfo); ok {
+		entry.Uid, entry.Gid = &uid, &gid
+	}
+	return entry, nil
+}
+
+// ListOptions of /finfo for directory
+//   - depth: levels of sub directories to list, default 1. symlinks to directory are not followed
+//   - glob: only list entries match any of the patterns, pattern contains / is matched with the path relative to the directory
+//   - sort: name, size or mtime, prefix - for descending order
+//   - limit and cursor: return at most limit entries after cursor, cursor is the nextCursor of the previous response
+type ListOptions struct {
+	Depth  int
+	Globs  []string
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+func (opts *ListOptions) Validate() error {
+	if opts.Depth == 0 {
+		opts.Depth = 1
+	}
+	if opts.Depth < 0 || opts.Depth > finfoMaxDepth {
+		return fmt.Errorf("depth should be in range [1, %d]", finfoMaxDepth)
+	}
+	if opts.Limit < 0 {
+		return fmt.Errorf("limit should not be negative")
+	}
+	for _, pattern := range opts.Globs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob: %q", pattern)
+		}
+	}
+	switch strings.TrimPrefix(opts.Sort, "-") {
+	case "", "name", "size", "mtime":
+	default:
+		return fmt.Errorf("sort should be one of name, size, mtime")
+	}
+	return nil
+}
+
+func (opts *ListOptions) match(relpath string) bool {
+	return len(opts.Globs) == 0 || globMatch(opts.Globs, relpath)
+}
+
+// less order entries by sort key, path is used when keys are the same, so the order is stable for cursor
+func (opts *ListOptions) less(a, b *FileEntry) bool {
+	desc := strings.HasPrefix(opts.Sort, "-")
+	switch strings.TrimPrefix(opts.Sort, "-") {
+	case "size":
+		if a.Size != b.Size {
+			return (a.Size < b.Size) != desc
+		}
+	case "mtime":
+		if a.ModTime != b.ModTime {
+			return (a.ModTime < b.ModTime) != desc
+		}
+	default:
+		return a.Path != b.Path && (a.Path < b.Path) != desc
+	}
+	return a.Path < b.Path
+}
+
+type listCursor struct {
+	Path    string `json:"p"`
+	Size    int64  `json:"s"`
+	ModTime int64  `json:"m"`
+}
+
+func encodeListCursor(entry *FileEntry) string {
+	data, _ := json.Marshal(listCursor{entry.Path, entry.Size, entry.ModTime})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(s string) (*FileEntry, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c listCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &FileEntry{Path: c.Path, Size: c.Size, ModTime: c.ModTime}, nil
+}
+
+// ListResult is the page of entries under a directory
+type ListResult struct {
+	Files      []*FileEntry `json:"files"`
+	Total      int          `json:"total"` // number of entries matched
+	NextCursor string       `json:"nextCursor,omitempty"`
+}
+
+// listDir list entries under realdir, lpath is the path reported to client.
+// The cursor is not a snapshot: every page walks the whole tree again to count total and keep the order for
+// any sort key, only the entries after the cursor are kept and sorted. A large tree is slow for every page.
+func listDir(lpath, realdir string, opts ListOptions) (*ListResult, error) {
+	var after *FileEntry
+	if opts.Cursor != "" {
+		var err error
+		if after, err = decodeListCursor(opts.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	entries := make([]*FileEntry, 0, 16) // after the cursor
+	total := 0
+	var walk func(relpath string, depth int) error
+	walk = func(relpath string, depth int) error {
+		f, err := os.Open(filepath.Join(realdir, relpath))
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			childRel := path.Join(relpath, name)
+			entry, err := newFileEntry(path.Join(lpath, childRel), filepath.Join(realdir, childRel))
+			if err != nil {
+				continue // removed during listing
+			}
+			if opts.match(childRel) {
+				total++
+				if after == nil || opts.less(after, entry) {
+					entries = append(entries, entry)
+				}
+			}
+			if entry.IsDirectory && !entry.IsSymlink && depth < opts.Depth {
+				if err := walk(childRel, depth+1); err != nil && depth == 1 {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("", 1); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return opts.less(entries[i], entries[j])
+	})
+	result := &ListResult{Total: total}
+	if opts.Limit > 0 && len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		result.NextCursor = encodeListCursor(entries[len(entries)-1])
+	}
+	result.Files = entries
+	return result, nil
+}
+
+func parseListOptions(form map[string][]string) (ListOptions, error) {
+	get := func(name string) string {
+		if values := form[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	opts := ListOptions{
+		Globs:  form["glob"],
+		Sort:   get("sort"),
+		Cursor: get("cursor"),
+	}
+	var err error
+	if s := get("depth"); s != "" {
+		if opts.Depth, err = strconv.Atoi(s); err != nil {
+			return opts, fmt.Errorf("invalid depth: %q", s)
+		}
+	}
+	if s := get("limit"); s != "" {
+		if opts.Limit, err = strconv.Atoi(s); err != nil {
+			return opts, fmt.Errorf("invalid limit: %q", s)
+		}
+	}
+	return opts, opts.Validate()
+}
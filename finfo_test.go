@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListDir(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "finfo")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	os.MkdirAll(filepath.Join(tmpdir, "DCIM/Camera"), 0755)
+	for i, name := range []string{"a.jpg", "b.png", "c.jpg", "DCIM/d.jpg", "DCIM/Camera/e.jpg"} {
+		p := filepath.Join(tmpdir, name)
+		ioutil.WriteFile(p, make([]byte, 10-i), 0644)
+		mtime := time.Unix(int64(1500000000+i), 0)
+		os.Chtimes(p, mtime, mtime)
+	}
+	os.Symlink("a.jpg", filepath.Join(tmpdir, "link.jpg"))
+	os.Symlink("missing", filepath.Join(tmpdir, "broken"))
+
+	paths := func(result *ListResult) []string {
+		ps := []string{}
+		for _, f := range result.Files {
+			ps = append(ps, f.Path)
+		}
+		return ps
+	}
+
+	result, err := listDir("/sdcard", tmpdir, ListOptions{Depth: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/sdcard/DCIM", "/sdcard/a.jpg", "/sdcard/b.png", "/sdcard/broken", "/sdcard/c.jpg", "/sdcard/link.jpg"}, paths(result))
+	link := result.Files[5]
+	assert.True(t, link.IsSymlink)
+	assert.Equal(t, "a.jpg", link.LinkTarget)
+	assert.Equal(t, int64(10), link.Size)
+	assert.True(t, result.Files[3].LinkBroken)
+
+	result, err = listDir("/sdcard", tmpdir, ListOptions{Depth: 3, Globs: []string{"*.jpg"}, Sort: "-size"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/sdcard/a.jpg", "/sdcard/link.jpg", "/sdcard/c.jpg", "/sdcard/DCIM/d.jpg", "/sdcard/DCIM/Camera/e.jpg"}, paths(result))
+
+	result, err = listDir("/sdcard", tmpdir, ListOptions{Depth: 2, Globs: []string{"DCIM/*"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/sdcard/DCIM/Camera", "/sdcard/DCIM/d.jpg"}, paths(result))
+
+	// pagination
+	opts := ListOptions{Depth: 3, Sort: "mtime", Limit: 2, Globs: []string{"*.jpg", "*.png"}}
+	var all []string
+	for {
+		result, err = listDir("/sdcard", tmpdir, opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 6, result.Total)
+		all = append(all, paths(result)...)
+		if result.NextCursor == "" {
+			break
+		}
+		opts.Cursor = result.NextCursor
+	}
+	assert.Equal(t, []string{"/sdcard/a.jpg", "/sdcard/link.jpg", "/sdcard/b.png", "/sdcard/c.jpg", "/sdcard/DCIM/d.jpg", "/sdcard/DCIM/Camera/e.jpg"}, all)
+
+	_, err = parseListOptions(map[string][]string{"sort": {"color"}})
+	assert.NotNil(t, err)
+	_, err = parseListOptions(map[string][]string{"depth": {"100"}})
+	assert.NotNil(t, err)
+}
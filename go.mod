@@ -6,6 +6,7 @@ require (
 	github.com/alecthomas/template v0.0.0-20160405071501-a0175ee3bccc // indirect
 	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf // indirect
 	github.com/codeskyblue/goreq v0.0.0-20180831024223-49450746aaef
+	github.com/creack/pty v1.1.11
 	github.com/dsnet/compress v0.0.0-20171208185109-cc9eb1d7ad76 // indirect
 	github.com/dustin/go-broadcast v0.0.0-20171205050544-f664265f5a66
 	github.com/franela/goblin v0.0.0-20181003173013-ead4ad1d2727 // indirect
@@ -23,6 +24,7 @@ require (
 	github.com/gorilla/websocket v1.4.0
 	github.com/kardianos/osext v0.0.0-20170510131534-ae77be60afb1 // indirect
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
+	github.com/klauspost/compress v1.11.13
 	github.com/kr/binarydist v0.1.0 // indirect
 	github.com/levigross/grequests v0.0.0-20190130132859-37c80f76a0da
 	github.com/mholt/archiver v2.0.1-0.20171012052341-26cf5bb32d07+incompatible
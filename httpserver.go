@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -16,8 +17,8 @@ import (
 	"time"
 	"runtime"
 	"github.com/openatx/atx-agent/jsonrpc"
-	"github.com/mholt/archiver"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/openatx/androidutils"
 	"github.com/openatx/atx-agent/cmdctrl"
 	"github.com/prometheus/procfs"
@@ -27,6 +28,8 @@ import (
 type Server struct {
 	// tunnel     *TunnelProxy
 	httpServer *http.Server
+	router     *mux.Router
+	upgrade    *pendingUpgrade // set by /upgrade before http server closed
 }
 
 func NewServer() *Server {
@@ -37,12 +40,14 @@ func NewServer() *Server {
 
 func (server *Server) initHTTPServer() {
 	m := mux.NewRouter()
+	m.Use(checkScope)
 
 	m.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "<html><head><title>BMW-Agent</title></head><body><h1>BMW-Agent is running</h1></body></html>")
 	})
 
 	m.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(agentPidHeader, strconv.Itoa(os.Getpid()))
 		io.WriteString(w, version)
 	})
 
@@ -317,6 +322,163 @@ func (server *Server) initHTTPServer() {
 		})
 	}).Methods("GET", "POST")
 
+	// websocket interactive shell, see term.go for message format
+	m.HandleFunc("/term", handleTerminal)
+
+	// logcat as websocket or server-sent events, see logcat.go for filters
+	m.HandleFunc("/logcat", handleLogcat).Methods("GET")
+
+	m.HandleFunc("/logcat/marks", func(w http.ResponseWriter, r *http.Request) {
+		mark, err := logcatCollector.AddMark(r.FormValue("name"))
+		if err != nil {
+			renderJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		renderJSON(w, mark)
+	}).Methods("POST")
+
+	m.HandleFunc("/logcat/marks", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, logcatCollector.Marks())
+	}).Methods("GET")
+
+	/*
+	 # Start command in background, it will keep running after request finished
+	 $ curl -X POST -d command="logcat -v time" $DEVICE_URL/shell/background
+	 $ curl $DEVICE_URL/shell/background/1/output?stdoutOffset=0&stderrOffset=0
+	 $ curl -X POST -d signal=TERM $DEVICE_URL/shell/background/1/signal
+	 $ curl $DEVICE_URL/shell/background/1/wait?timeout=30s
+	*/
+	shellJobs := NewShellJobManager()
+
+	m.HandleFunc("/shell/background", func(w http.ResponseWriter, r *http.Request) {
+		command := r.FormValue("command")
+		if command == "" {
+			command = r.FormValue("c")
+		}
+		if command == "" {
+			http.Error(w, "command is required", http.StatusBadRequest)
+			return
+		}
+		job, err := shellJobs.Start(command)
+		if err != nil {
+			w.WriteHeader(500)
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success": true,
+			"id":      job.ID,
+			"pid":     job.Pid(),
+		})
+	}).Methods("POST")
+
+	m.HandleFunc("/shell/background", func(w http.ResponseWriter, r *http.Request) {
+		infos := make([]map[string]interface{}, 0)
+		for _, job := range shellJobs.List() {
+			infos = append(infos, job.Info())
+		}
+		renderJSON(w, infos)
+	}).Methods("GET")
+
+	m.HandleFunc("/shell/background/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		job, ok := shellJobs.Get(id)
+		if !ok {
+			http.Error(w, "shell job "+strconv.Quote(id)+" not found", http.StatusNotFound)
+			return
+		}
+		renderJSON(w, job.Info())
+	}).Methods("GET")
+
+	// kill if still running and remove from list
+	m.HandleFunc("/shell/background/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if err := shellJobs.Remove(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "removed",
+		})
+	}).Methods("DELETE")
+
+	// read output after offset, use returned offset for next read
+	m.HandleFunc("/shell/background/{id}/output", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		job, ok := shellJobs.Get(id)
+		if !ok {
+			http.Error(w, "shell job "+strconv.Quote(id)+" not found", http.StatusNotFound)
+			return
+		}
+		stdoutOffset, _ := strconv.ParseInt(r.FormValue("stdoutOffset"), 10, 64)
+		stderrOffset, _ := strconv.ParseInt(r.FormValue("stderrOffset"), 10, 64)
+		running := job.Running() // check before read, so no output lost after exited
+		stdout, stdoutOffset := job.Stdout.Since(stdoutOffset)
+		stderr, stderrOffset := job.Stderr.Since(stderrOffset)
+		renderJSON(w, map[string]interface{}{
+			"running":      running,
+			"stdout":       string(stdout),
+			"stdoutOffset": stdoutOffset,
+			"stderr":       string(stderr),
+			"stderrOffset": stderrOffset,
+		})
+	}).Methods("GET")
+
+	m.HandleFunc("/shell/background/{id}/signal", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		job, ok := shellJobs.Get(id)
+		if !ok {
+			http.Error(w, "shell job "+strconv.Quote(id)+" not found", http.StatusNotFound)
+			return
+		}
+		name := r.FormValue("signal")
+		if name == "" {
+			name = "TERM"
+		}
+		sig, err := parseSignal(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := job.Signal(sig); err != nil {
+			w.WriteHeader(400) // bad request
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "signal " + sig.String() + " sent",
+		})
+	}).Methods("POST")
+
+	// wait until command exited or timeout (default 30s)
+	m.HandleFunc("/shell/background/{id}/wait", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		job, ok := shellJobs.Get(id)
+		if !ok {
+			http.Error(w, "shell job "+strconv.Quote(id)+" not found", http.StatusNotFound)
+			return
+		}
+		timeout, err := time.ParseDuration(r.FormValue("timeout"))
+		if err != nil {
+			timeout = 30 * time.Second
+		}
+		select {
+		case <-job.Done():
+		case <-time.After(timeout):
+		case <-r.Context().Done():
+			return
+		}
+		renderJSON(w, job.Info())
+	}).Methods("GET")
+
 	m.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("stop all service")
 		service.StopAll()
@@ -329,6 +491,53 @@ func (server *Server) initHTTPServer() {
 		}()
 	})
 
+	m.HandleFunc("/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		updater, err := NewSelfUpdater()
+		if err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		ver := r.FormValue("version")
+		if ver == "" || ver == "latest" {
+			ver, err = updater.LatestVersion()
+			if err != nil {
+				http.Error(w, "get latest version: "+err.Error(), 500)
+				return
+			}
+		}
+		if ver == version && r.FormValue("force") != "true" {
+			renderJSON(w, map[string]interface{}{
+				"success":     true,
+				"description": "already version " + version,
+			})
+			return
+		}
+		if err := updater.Update(ver); err != nil {
+			log.Printf("upgrade to %s failed: %v", ver, err)
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "upgrade to " + ver + " failed: " + err.Error(),
+			})
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "upgraded from " + version + " to " + ver + ", restarting",
+		})
+		go func() {
+			time.Sleep(500 * time.Millisecond)
+			// the new version is started by main after http server closed, and this process exits
+			server.upgrade = &pendingUpgrade{updater: updater, version: ver}
+			service.StopAll()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.httpServer.Shutdown(ctx)
+		}()
+	}).Methods("GET", "POST")
+
 	m.HandleFunc("/services/{name}", func(w http.ResponseWriter, r *http.Request) {
 		name := mux.Vars(r)["name"]
 		var resp map[string]interface{}
@@ -400,12 +609,52 @@ func (server *Server) initHTTPServer() {
 
 	m.HandleFunc("/raw/{filepath:.*}", func(w http.ResponseWriter, r *http.Request) {
 		filepath := "/" + mux.Vars(r)["filepath"]
-		http.ServeFile(w, r, filepath)
+		realpath, err := fsSandbox.Resolve(filepath)
+		if err != nil {
+			renderPathError(w, err, http.StatusBadRequest)
+			return
+		}
+		format := r.FormValue("archive")
+		if format == "" {
+			http.ServeFile(w, r, realpath)
+			return
+		}
+		// stream file or directory as zip, tar or tar.gz
+		ftype, ok := archiveFormats[format]
+		if !ok {
+			http.Error(w, "archive should be one of zip, tar, tar.gz", http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(realpath); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", ftype[0])
+		w.Header().Set("Content-Disposition", "attachment; filename="+archiveBaseName(realpath)+ftype[1])
+		filter := ArchiveFilter{Includes: r.Form["include"], Excludes: r.Form["exclude"]}
+		if err := writeArchive(w, format, realpath, filter); err != nil {
+			log.Printf("archive %s error: %v", realpath, err)
+		}
 	})
 
 	m.HandleFunc("/finfo/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
 		lpath := "/" + mux.Vars(r)["lpath"]
-		finfo, err := os.Stat(lpath)
+		realpath, err := fsSandbox.Resolve(lpath)
+		if err != nil {
+			renderPathError(w, err, http.StatusBadRequest)
+			return
+		}
+		opts, err := parseListOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// report the symlink itself when lpath is a link
+		entryPath, err := fsSandbox.ResolveEntry(lpath)
+		if err != nil {
+			entryPath = realpath
+		}
+		entry, err := newFileEntry(lpath, entryPath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				http.Error(w, err.Error(), 404)
@@ -414,29 +663,218 @@ func (server *Server) initHTTPServer() {
 			}
 			return
 		}
-		data := make(map[string]interface{}, 5)
-		data["name"] = finfo.Name()
-		data["path"] = lpath
-		data["isDirectory"] = finfo.IsDir()
-		data["size"] = finfo.Size()
-
-		if finfo.IsDir() {
-			files, err := ioutil.ReadDir(lpath)
-			if err == nil {
-				finfos := make([]map[string]interface{}, 0, 3)
-				for _, f := range files {
-					finfos = append(finfos, map[string]interface{}{
-						"name":        f.Name(),
-						"path":        filepath.Join(lpath, f.Name()),
-						"isDirectory": f.IsDir(),
-					})
-				}
-				data["files"] = finfos
+		var list *ListResult
+		if entry.IsDirectory {
+			list, err = listDir(lpath, realpath, opts)
+			if err != nil && !os.IsPermission(err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 		}
-		renderJSON(w, data)
+		renderJSON(w, struct {
+			*FileEntry
+			*ListResult
+		}{entry, list})
 	})
 
+	// checksum of file as json, or every file under directory as json lines
+	// algorithm: md5, sha1, sha256 (default), can be comma separated
+	m.HandleFunc("/checksum/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		realpath, err := fsSandbox.Resolve(lpath)
+		if err != nil {
+			renderPathError(w, err, http.StatusBadRequest)
+			return
+		}
+		algorithms, err := parseAlgorithms(r.FormValue("algorithm"))
+		if err != nil {
+			renderJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		finfo, err := os.Stat(realpath)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		if !finfo.IsDir() {
+			record := checksumRecord(lpath, realpath, algorithms)
+			if errmsg, ok := record["error"]; ok {
+				renderJSONError(w, http.StatusInternalServerError, errmsg.(string))
+				return
+			}
+			renderJSON(w, record)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := writeTreeChecksums(w, lpath, realpath, algorithms, r.Form["glob"]); err != nil {
+			log.Printf("checksum %s error: %v", realpath, err)
+		}
+	}).Methods("GET")
+
+	// post manifest to get files need to upload, and delete extra files when delete is true
+	m.HandleFunc("/sync/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		realdir, err := fsSandbox.Resolve(lpath)
+		if err != nil {
+			renderPathError(w, err, http.StatusBadRequest)
+			return
+		}
+		var manifest SyncManifest
+		if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+			renderJSONError(w, http.StatusBadRequest, "invalid manifest: "+err.Error())
+			return
+		}
+		result, err := diffManifest(realdir, manifest)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, result)
+	}).Methods("POST")
+
+	// upload one file of sync, body is the file content
+	// $ curl -X PUT "$DEVICE_URL/sync/sdcard/assets?path=img/a.png&checksum=sha256:..." --data-binary @a.png
+	m.HandleFunc("/sync/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		realdir, err := fsSandbox.Resolve(lpath)
+		if err != nil {
+			renderPathError(w, err, http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		rel := query.Get("path")
+		if rel == "" {
+			renderJSONError(w, http.StatusBadRequest, "path is required")
+			return
+		}
+		mode, err := parseFileMode(query.Get("mode"), 0644)
+		if err != nil {
+			renderJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		target, err := receiveSyncFile(realdir, rel, r.Body, query.Get("checksum"), mode)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		entry, err := newFileEntry(path.Join(lpath, filepath.ToSlash(rel)), target)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, entry)
+	}).Methods("PUT")
+
+	m.HandleFunc("/files/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		realpath, err := fsSandbox.ResolveEntry(lpath)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		entry, err := newFileEntry(lpath, realpath)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		if err := removePath(realpath, formBool(r, "recursive")); err != nil {
+			renderFileError(w, err)
+			return
+		}
+		log.Println("removed", realpath)
+		renderJSON(w, entry)
+	}).Methods("DELETE")
+
+	// action: move, copy (dst, overwrite), mkdir (mode, parents), chmod (mode, recursive)
+	m.HandleFunc("/files/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		resultPath := lpath
+		var realpath string
+		var err error
+		switch action := r.FormValue("action"); action {
+		case "move", "copy":
+			if r.FormValue("dst") == "" {
+				renderJSONError(w, http.StatusBadRequest, "dst is required")
+				return
+			}
+			resultPath = filepath.Clean(r.FormValue("dst"))
+			var dst string
+			if realpath, err = fsSandbox.ResolveEntry(lpath); err != nil {
+				break
+			}
+			if dst, err = fsSandbox.ResolveEntry(resultPath); err != nil {
+				break
+			}
+			if _, err = os.Lstat(realpath); err != nil {
+				break
+			}
+			err = transferPath(realpath, dst, action == "move", formBool(r, "overwrite"))
+			realpath = dst
+		case "mkdir":
+			var mode os.FileMode
+			if mode, err = parseFileMode(r.FormValue("mode"), 0755); err != nil {
+				renderJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if realpath, err = fsSandbox.Resolve(lpath); err != nil {
+				break
+			}
+			if formBool(r, "parents") {
+				err = os.MkdirAll(realpath, mode)
+			} else {
+				err = os.Mkdir(realpath, mode)
+			}
+		case "chmod":
+			var mode os.FileMode
+			if mode, err = parseFileMode(r.FormValue("mode"), 0); err != nil || r.FormValue("mode") == "" {
+				renderJSONError(w, http.StatusBadRequest, "mode is required, eg: 0644")
+				return
+			}
+			if realpath, err = fsSandbox.Resolve(lpath); err != nil {
+				break
+			}
+			err = chmodPath(realpath, mode, formBool(r, "recursive"))
+		default:
+			renderJSONError(w, http.StatusBadRequest, "unknown action: "+strconv.Quote(action)+", should be one of move, copy, mkdir, chmod")
+			return
+		}
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		entry, err := newFileEntry(resultPath, realpath)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, entry)
+	}).Methods("POST")
+
+	// touch: update mtime, create the file when not exists unless create=false
+	m.HandleFunc("/files/{lpath:.*}", func(w http.ResponseWriter, r *http.Request) {
+		lpath := "/" + mux.Vars(r)["lpath"]
+		mtime, err := parseMtime(r.FormValue("mtime"))
+		if err != nil {
+			renderJSONError(w, http.StatusBadRequest, "invalid mtime, should be unix timestamp or RFC3339")
+			return
+		}
+		realpath, err := fsSandbox.Resolve(lpath)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		if err := touchPath(realpath, mtime, r.FormValue("create") != "false"); err != nil {
+			renderFileError(w, err)
+			return
+		}
+		entry, err := newFileEntry(lpath, realpath)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, entry)
+	}).Methods("PATCH")
+
 	// keep ApkService always running
 	// if no activity in 5min, then restart apk service
 	const apkServiceTimeout = 5 * time.Minute
@@ -526,46 +964,194 @@ func (server *Server) initHTTPServer() {
 			r.MultipartForm.RemoveAll()
 		}()
 
-		var targetDir = target
 		if !isDir {
 			if strings.HasSuffix(target, "/") {
 				target = path.Join(target, header.Filename)
 			}
-			targetDir = filepath.Dir(target)
 		} else {
 			if !strings.HasSuffix(target, "/") {
 				http.Error(w, "URLPath must endswith / if upload a directory", 400)
 				return
 			}
 		}
+		// write to the path checked by the sandbox, not the one given
+		realTarget, err := fsSandbox.Resolve(target)
+		if err != nil {
+			renderPathError(w, err, http.StatusBadRequest)
+			return
+		}
+		var targetDir = realTarget
+		if !isDir {
+			targetDir = filepath.Dir(realTarget)
+		}
 		if _, err := os.Stat(targetDir); os.IsNotExist(err) {
 			os.MkdirAll(targetDir, 0755)
 		}
 
+		var format string
+		var files []string
 		if isDir {
-			err = archiver.Zip.Read(file, target)
+			format, files, err = extractArchive(file, header.Size, r.FormValue("format"), realTarget)
 		} else {
-			err = copyToFile(file, target)
+			err = copyToFile(file, realTarget)
 		}
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			renderPathError(w, err, http.StatusInternalServerError)
 			return
 		}
 		if !isDir && fileMode != 0 {
-			os.Chmod(target, fileMode)
+			os.Chmod(realTarget, fileMode)
 		}
-		if fileInfo, err := os.Stat(target); err == nil {
+		if fileInfo, err := os.Stat(realTarget); err == nil {
 			fileMode = fileInfo.Mode()
 		}
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(map[string]interface{}{
+		resp := map[string]interface{}{
 			"target": target,
 			"isDir":  isDir,
 			"mode":   fmt.Sprintf("0%o", fileMode),
-		})
+		}
+		if isDir {
+			resp["format"] = format
+			resp["files"] = files
+		}
+		json.NewEncoder(w).Encode(resp)
 	})
 
+	/*
+	 Resumable upload for large files
+	 $ curl -X POST $DEVICE_URL/uploads -d target=/sdcard/main.obb -d size=1048576 [-d sha256=...] [-d mode=0644]
+	   size can also be given by header Upload-Length
+	 $ curl -X PATCH $DEVICE_URL/uploads/{id} -H "Upload-Offset: 0" --data-binary @chunk
+	 $ curl $DEVICE_URL/uploads/{id} # query offset after connection dropped
+	 $ curl -X POST $DEVICE_URL/uploads/{id}/finish [-d sha256=...]
+	*/
+	uploads := NewUploadManager()
+
+	m.HandleFunc("/uploads", func(w http.ResponseWriter, r *http.Request) {
+		target := r.FormValue("target")
+		if target == "" || strings.HasSuffix(target, "/") {
+			renderJSONError(w, http.StatusBadRequest, "target should be a file path")
+			return
+		}
+		realTarget, err := fsSandbox.Resolve(target)
+		if err != nil {
+			renderPathError(w, err, http.StatusBadRequest)
+			return
+		}
+		size := int64(-1)
+		sizeStr := r.FormValue("size")
+		if sizeStr == "" {
+			sizeStr = r.Header.Get("Upload-Length")
+		}
+		if sizeStr != "" {
+			if size, err = strconv.ParseInt(sizeStr, 10, 64); err != nil || size < 0 {
+				renderJSONError(w, http.StatusBadRequest, "invalid size: "+sizeStr)
+				return
+			}
+		}
+		mode, err := parseFileMode(r.FormValue("mode"), 0644)
+		if err != nil {
+			renderJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		session, err := uploads.Create(target, realTarget, size, mode, r.FormValue("sha256"))
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		log.Printf("upload %s to %s created", session.ID, realTarget)
+		w.Header().Set("Location", "/uploads/"+session.ID)
+		renderJSON(w, session.Info())
+	}).Methods("POST")
+
+	m.HandleFunc("/uploads", func(w http.ResponseWriter, r *http.Request) {
+		infos := make([]map[string]interface{}, 0)
+		for _, session := range uploads.List() {
+			infos = append(infos, session.Info())
+		}
+		renderJSON(w, infos)
+	}).Methods("GET")
+
+	m.HandleFunc("/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		session, ok := uploads.Get(mux.Vars(r)["id"])
+		if !ok {
+			renderJSONError(w, http.StatusNotFound, "upload not found")
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset(), 10))
+		if session.Size >= 0 {
+			w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+		}
+		renderJSON(w, session.Info())
+	}).Methods("GET")
+
+	// write request body at offset, which is from header Upload-Offset or query offset
+	m.HandleFunc("/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		session, ok := uploads.Get(mux.Vars(r)["id"])
+		if !ok {
+			renderJSONError(w, http.StatusNotFound, "upload not found")
+			return
+		}
+		offsetStr := r.Header.Get("Upload-Offset")
+		if offsetStr == "" {
+			offsetStr = r.URL.Query().Get("offset")
+		}
+		offset, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil {
+			renderJSONError(w, http.StatusBadRequest, "Upload-Offset is required")
+			return
+		}
+		newOffset, err := session.Append(offset, r.Body)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		if err != nil {
+			status := uploadErrorStatus(err)
+			js, _ := json.Marshal(map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+				"offset":      newOffset,
+			})
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(status)
+			w.Write(js)
+			return
+		}
+		renderJSON(w, session.Info())
+	}).Methods("PATCH")
+
+	m.HandleFunc("/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := uploads.Remove(mux.Vars(r)["id"]); err != nil {
+			renderJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "removed",
+		})
+	}).Methods("DELETE")
+
+	// verify size and sha256, then move to target. The upload is removed when checksum mismatch
+	m.HandleFunc("/uploads/{id}/finish", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		session, ok := uploads.Get(id)
+		if !ok {
+			renderJSONError(w, http.StatusNotFound, "upload not found")
+			return
+		}
+		if err := uploads.Finish(id, r.FormValue("sha256")); err != nil {
+			renderJSONError(w, uploadErrorStatus(err), err.Error())
+			return
+		}
+		log.Printf("upload %s finished: %s", id, session.Target)
+		entry, err := newFileEntry(session.Target, session.realTarget)
+		if err != nil {
+			renderFileError(w, err)
+			return
+		}
+		renderJSON(w, entry)
+	}).Methods("POST")
+
 	m.HandleFunc("/packages", func(w http.ResponseWriter, r *http.Request) {
 		pkgs, err := listPackages()
 		if err != nil {
@@ -595,15 +1181,173 @@ func (server *Server) initHTTPServer() {
 		})
 	})
 
-	screenshotIndex := -1
-	nextScreenshotFilename := func() string {
-		targetFolder := "/data/local/tmp/minicap-images"
-		if _, err := os.Stat(targetFolder); err != nil {
-			os.MkdirAll(targetFolder, 0755)
+	/*
+	 # format: png(default), jpeg or webp. size: max width and height
+	 $ curl "$DEVICE_URL/packages/com.example.app/icon?format=webp&size=64"
+	*/
+	packageIcons := NewPackageIconCache()
+
+	m.HandleFunc("/packages/{pkgname}/icon", func(w http.ResponseWriter, r *http.Request) {
+		pkgname := mux.Vars(r)["pkgname"]
+		format := r.FormValue("format")
+		if format == "" {
+			format = "png"
 		}
-		screenshotIndex = (screenshotIndex + 1) % 5
-		return filepath.Join(targetFolder, fmt.Sprintf("%d.jpg", screenshotIndex))
-	}
+		contentType := imageContentType(format)
+		if contentType == "" {
+			http.Error(w, "unsupported format: "+format, http.StatusBadRequest)
+			return
+		}
+		size, _ := strconv.Atoi(r.FormValue("size"))
+		quality, _ := strconv.Atoi(r.FormValue("quality"))
+
+		apkPath, err := getPackagePath(pkgname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		data, modTime, err := packageIcons.Encoded(apkPath, format, size, quality)
+		if err == errPackageNoIcon {
+			http.Error(w, "package "+strconv.Quote(pkgname)+" has no icon", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(data))
+	}).Methods("GET")
+
+	/*
+	 # Install apk from url, returns install id
+	 $ curl -X POST -d url=http://some-host/some.apk -d launch=true $DEVICE_URL/install
+	 $ curl $DEVICE_URL/install/1
+	 $ curl -X DELETE $DEVICE_URL/install/1 # cancel
+	*/
+	installManager := NewInstallManager()
+
+	m.HandleFunc("/install", func(w http.ResponseWriter, r *http.Request) {
+		id, err := installManager.Install(r.FormValue("url"), r.FormValue("launch") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, id)
+	}).Methods("POST")
+
+	m.HandleFunc("/install", func(w http.ResponseWriter, r *http.Request) {
+		infos := make([]map[string]interface{}, 0)
+		for _, job := range installManager.List() {
+			infos = append(infos, InstallInfo(job))
+		}
+		renderJSON(w, infos)
+	}).Methods("GET")
+
+	m.HandleFunc("/install/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		job, ok := installManager.Get(id)
+		if !ok {
+			http.Error(w, "install "+strconv.Quote(id)+" not found", http.StatusNotFound)
+			return
+		}
+		renderJSON(w, InstallInfo(job))
+	}).Methods("GET")
+
+	m.HandleFunc("/install/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, ok := installManager.Get(id); !ok {
+			http.Error(w, "install "+strconv.Quote(id)+" not found", http.StatusNotFound)
+			return
+		}
+		if err := installManager.Cancel(id); err != nil {
+			w.WriteHeader(400) // bad request
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "canceled",
+		})
+	}).Methods("DELETE")
+
+	/*
+	 # Offline download, returns download id
+	 $ curl -F url=http://some-host/some.mp4 -F filepath=/sdcard/some.mp4 -F mode=0644 \
+	 	-F checksum=sha256:2c26b46b... $DEVICE_URL/download
+	 $ curl $DEVICE_URL/download/1
+	 $ curl -X DELETE $DEVICE_URL/download/1 # cancel, post again to resume
+	*/
+	downloadManager := NewDownloadManager()
+
+	m.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		opts := DownloadOptions{
+			URL:      r.FormValue("url"),
+			Filepath: r.FormValue("filepath"),
+			Checksum: r.FormValue("checksum"),
+		}
+		if mode := r.FormValue("mode"); mode != "" {
+			if _, err := fmt.Sscanf(mode, "%o", &opts.Mode); err != nil {
+				http.Error(w, "invalid file mode: "+mode, http.StatusBadRequest)
+				return
+			}
+		}
+		if opts.Filepath != "" {
+			realpath, err := fsSandbox.Resolve(opts.Filepath)
+			if err != nil {
+				renderPathError(w, err, http.StatusBadRequest)
+				return
+			}
+			opts.Filepath = realpath
+		}
+		id, err := downloadManager.Download(opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		io.WriteString(w, id)
+	}).Methods("POST")
+
+	m.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		infos := make([]map[string]interface{}, 0)
+		for _, job := range downloadManager.List() {
+			infos = append(infos, DownloadInfo(job))
+		}
+		renderJSON(w, infos)
+	}).Methods("GET")
+
+	m.HandleFunc("/download/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		job, ok := downloadManager.Get(id)
+		if !ok {
+			http.Error(w, "download "+strconv.Quote(id)+" not found", http.StatusNotFound)
+			return
+		}
+		renderJSON(w, DownloadInfo(job))
+	}).Methods("GET")
+
+	m.HandleFunc("/download/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, ok := downloadManager.Get(id); !ok {
+			http.Error(w, "download "+strconv.Quote(id)+" not found", http.StatusNotFound)
+			return
+		}
+		if err := downloadManager.Cancel(id); err != nil {
+			w.WriteHeader(400) // bad request
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "canceled",
+		})
+	}).Methods("DELETE")
 
 	m.HandleFunc("/screenshot", func(w http.ResponseWriter, r *http.Request) {
 		targetURL := "/screenshot/0"
@@ -613,47 +1357,248 @@ func (server *Server) initHTTPServer() {
 		http.Redirect(w, r, targetURL, 302)
 	}).Methods("GET")
 
+	m.HandleFunc("/screenshot/mjpeg", handleMJPEG).Methods("GET")
+
+	m.HandleFunc("/screenshot/metrics", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, screenshotCapturer.Metrics())
+	}).Methods("GET")
+
 	m.Handle("/jsonrpc/0", uiautomatorProxy)
 	m.Handle("/ping", uiautomatorProxy)
+	/*
+	 # format: png, jpeg or webp. quality: 1-100 for jpeg. size (or maxWidth, maxHeight): scale down to fit
+	 # crop: x,y,width,height. rotate: auto, 0, 90, 180, 270
+	 $ curl "$DEVICE_URL/screenshot/0?format=jpeg&quality=60&size=800&rotate=auto&crop=0,0,1080,200"
+	*/
 	m.HandleFunc("/screenshot/0", func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseScreenshotOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		download := r.FormValue("download")
 		if download != "" {
 			w.Header().Set("Content-Disposition", "attachment; filename="+download)
 		}
 
-		filename := nextScreenshotFilename()
+		// data is shared with concurrent requests, never modify it
+		data, method, err := screenshotCapturer.Take(r.FormValue("minicap") != "false")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		// screencap writes png, minicap and uiautomator jpeg
+		contentType := http.DetectContentType(data)
+		if !opts.IsZero() {
+			displayWidth, displayHeight := naturalDisplaySize()
+			data, contentType, err = transformScreenshot(data, opts, deviceRotation, displayWidth, displayHeight)
+			if err == errCropOutside {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		w.Header().Set("X-Screenshot-Method", method)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	})
 
-		// android emulator use screencap
-		// then minicap when binary and .so exists
-		// then uiautomator when service(uiautomator) is running
-		// last screencap
+	m.HandleFunc("/minicap", singleFightNewerWebsocket(func(w http.ResponseWriter, r *http.Request, ws *websocket.Conn) {
+		defer ws.Close()
+		const wsWriteWait = 10 * time.Second
+		wsWrite := func(messageType int, data []byte) error {
+			ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			return ws.WriteMessage(messageType, data)
+		}
+		log.Printf("minicap connection: %v", r.RemoteAddr)
+		quitC := make(chan bool)
+		go func() {
+			defer close(quitC)
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		dataC := make(chan []byte, 10)
+		go streamScreen(dataC, quitC)
 
-		method := "screencap"
-		if getCachedProperty("ro.product.cpu.abi") == "x86" { // android emulator
-			method = "screencap"
-		} else if service.Running("uiautomator") {
-			method = "uiautomator"
+		num := 0
+		for data := range dataC {
+			if bytes.HasPrefix(data, []byte("\xff\xd8")) { // jpeg data
+				if err := wsWrite(websocket.BinaryMessage, data); err != nil {
+					break
+				}
+				if num%50 == 0 {
+					log.Println("send image", num, len(data))
+				}
+				num++
+			} else {
+				if err := wsWrite(websocket.TextMessage, data); err != nil {
+					break
+				}
+			}
 		}
+		log.Println("stream finished")
+	})).Methods("GET")
 
-		var err error
-		switch method {
-		case "screencap":
-			err = screenshotWithScreencap(filename)
-		case "uiautomator":
-			uiautomatorProxy.ServeHTTP(w, r)
+	// reinstall minicap
+	m.HandleFunc("/minicap", func(w http.ResponseWriter, r *http.Request) {
+		minicap.StopService()
+		if err := minicap.Install(); err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
 			return
 		}
-		if err != nil && method != "screencap" {
-			method = "screencap"
-			err = screenshotWithScreencap(filename)
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "minicap installed",
+		})
+	}).Methods("PUT")
+
+	m.HandleFunc("/minitouch", singleFightNewerWebsocket(func(w http.ResponseWriter, r *http.Request, ws *websocket.Conn) {
+		defer ws.Close()
+		if !minitouch.Available() {
+			ws.WriteMessage(websocket.TextMessage, []byte("minitouch is not available, try PUT /minitouch"))
+			return
 		}
+		ws.WriteMessage(websocket.TextMessage, []byte("dial unix:@minitouch"))
+		conn, _, banner, err := minitouch.Dial()
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			ws.WriteMessage(websocket.TextMessage, []byte(err.Error()))
 			return
 		}
-		w.Header().Set("X-Screenshot-Method", method)
-		http.ServeFile(w, r, filename)
-	})
+		defer conn.Close()
+		go io.Copy(ioutil.Discard, conn) // ignore the rest output
+		log.Printf("minitouch connection: %v, banner: %+v", r.RemoteAddr, banner)
+		ws.WriteJSON(banner)
+
+		display := getDeviceInfo().Display
+		defer conn.Write([]byte("r\n")) // release all contacts
+		for {
+			var req TouchRequest
+			if err := ws.ReadJSON(&req); err != nil {
+				switch err.(type) {
+				case *json.SyntaxError, *json.UnmarshalTypeError:
+					ws.WriteMessage(websocket.TextMessage, []byte("invalid json: "+err.Error()))
+					continue
+				}
+				break
+			}
+			line, err := req.MinitouchCommand(banner, display.Width, display.Height, deviceRotation)
+			if err != nil {
+				ws.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+				continue
+			}
+			if _, err := io.WriteString(conn, line); err != nil {
+				ws.WriteMessage(websocket.TextMessage, []byte("write to @minitouch: "+err.Error()))
+				break
+			}
+		}
+		log.Println("minitouch connection closed")
+	})).Methods("GET")
+
+	// reinstall minitouch
+	m.HandleFunc("/minitouch", func(w http.ResponseWriter, r *http.Request) {
+		running := service.Running("minitouch")
+		service.Stop("minitouch", true)
+		if err := minitouch.Install(); err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		if running {
+			service.Start("minitouch")
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "minitouch installed",
+		})
+	}).Methods("PUT")
+
+	m.HandleFunc("/screenrecord", func(w http.ResponseWriter, r *http.Request) {
+		opts := ScreenRecordOptions{
+			Size:           r.FormValue("size"),
+			Rotate:         r.FormValue("rotate") == "true",
+			SegmentSeconds: screenrecordDefaultSegment,
+		}
+		var err error
+		if bitrate := r.FormValue("bitrate"); bitrate != "" {
+			if opts.BitRate, err = parseBitRate(bitrate); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if segment := r.FormValue("segment"); segment != "" {
+			if opts.SegmentSeconds, err = strconv.Atoi(segment); err != nil {
+				http.Error(w, "invalid segment: "+segment, http.StatusBadRequest)
+				return
+			}
+		}
+		if err := opts.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := screenRecorder.Start(opts); err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			})
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "screenrecord started",
+		})
+	}).Methods("POST")
+
+	m.HandleFunc("/screenrecord", func(w http.ResponseWriter, r *http.Request) {
+		videos, err := screenRecorder.Stop()
+		resp := map[string]interface{}{
+			"success": err == nil,
+			"videos":  videos,
+		}
+		if err != nil {
+			resp["description"] = err.Error()
+		}
+		renderJSON(w, resp)
+	}).Methods("PUT")
+
+	m.HandleFunc("/screenrecord", func(w http.ResponseWriter, r *http.Request) {
+		renderJSON(w, screenRecorder.Status())
+	}).Methods("GET")
+
+	m.HandleFunc("/screenrecord/playlist.m3u", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/x-mpegurl")
+		screenRecorder.WritePlaylist(w, "videos/")
+	}).Methods("GET")
+
+	m.HandleFunc("/screenrecord/bundle.zip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=screenrecord.zip")
+		if err := screenRecorder.WriteZip(w); err != nil {
+			log.Println("screenrecord bundle:", err)
+		}
+	}).Methods("GET")
+
+	m.HandleFunc("/screenrecord/videos/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		for _, video := range screenRecorder.Videos() {
+			if filepath.Base(video) == name {
+				http.ServeFile(w, r, video)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}).Methods("GET")
 
 	m.HandleFunc("/wlan/ip", func(w http.ResponseWriter, r *http.Request) {
 		itf, err := net.InterfaceByName("wlan0")
@@ -675,9 +1620,16 @@ func (server *Server) initHTTPServer() {
 		http.Error(w, "wlan0 have no ip address", 500)
 	})
 
+	server.router = m
+	var routes http.Handler = m
+	if authenticator != nil {
+		routes = authenticator.Wrap(m)
+	}
 	var handler = cors.New(cors.Options{
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
-	}).Handler(m)
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "Upload-Offset", "Upload-Length"},
+		ExposedHeaders: []string{"Upload-Offset", "Upload-Length", "Location"},
+	}).Handler(routes)
 	// logHandler := handlers.LoggingHandler(os.Stdout, handler)
 	server.httpServer = &http.Server{Handler: handler} // url(/stop) need it.
 }
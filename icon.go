@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errPackageNoIcon = errors.New("package has no icon")
+
+// encoded icons more than this will clear the cache
+const maxEncodedIcons = 256
+
+type cachedIcon struct {
+	modTime time.Time
+	size    int64
+	icon    image.Image // nil if apk has no icon
+}
+
+// PackageIconCache cache icons by apk path, cache is invalid when apk changed (eg: upgraded)
+type PackageIconCache struct {
+	mu      sync.Mutex
+	icons   map[string]cachedIcon
+	encoded map[string][]byte
+}
+
+func NewPackageIconCache() *PackageIconCache {
+	return &PackageIconCache{
+		icons:   make(map[string]cachedIcon),
+		encoded: make(map[string][]byte),
+	}
+}
+
+// Icon return decoded icon of apk
+func (c *PackageIconCache) Icon(apkPath string) (image.Image, time.Time, error) {
+	finfo, err := os.Stat(apkPath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	c.mu.Lock()
+	cached, ok := c.icons[apkPath]
+	c.mu.Unlock()
+	if !ok || !cached.modTime.Equal(finfo.ModTime()) || cached.size != finfo.Size() {
+		info, err := readPackageInfoFromPath(apkPath)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		cached = cachedIcon{modTime: finfo.ModTime(), size: finfo.Size(), icon: info.Icon}
+		c.mu.Lock()
+		c.icons[apkPath] = cached
+		c.mu.Unlock()
+	}
+	if cached.icon == nil {
+		return nil, cached.modTime, errPackageNoIcon
+	}
+	return cached.icon, cached.modTime, nil
+}
+
+// Encoded return icon encoded with format, maxSize limit both width and height, 0 means original size
+func (c *PackageIconCache) Encoded(apkPath string, format string, maxSize int, quality int) ([]byte, time.Time, error) {
+	icon, modTime, err := c.Icon(apkPath)
+	if err != nil {
+		return nil, modTime, err
+	}
+	key := fmt.Sprintf("%s|%d|%s|%d|%d", apkPath, modTime.UnixNano(), format, maxSize, quality)
+	c.mu.Lock()
+	data, ok := c.encoded[key]
+	c.mu.Unlock()
+	if ok {
+		return data, modTime, nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := encodeImage(buf, resizeImage(icon, maxSize, maxSize), format, quality); err != nil {
+		return nil, modTime, err
+	}
+	data = buf.Bytes()
+	c.mu.Lock()
+	if len(c.encoded) >= maxEncodedIcons {
+		c.encoded = make(map[string][]byte)
+	}
+	c.encoded[key] = data
+	c.mu.Unlock()
+	return data, modTime, nil
+}
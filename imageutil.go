@@ -0,0 +1,134 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+func nrgbaAt(img image.Image, x, y int) color.NRGBA {
+	switch m := img.(type) {
+	case *image.NRGBA:
+		i := m.PixOffset(x, y)
+		return color.NRGBA{m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3]}
+	case *image.RGBA:
+		i := m.PixOffset(x, y)
+		if m.Pix[i+3] == 0xff {
+			return color.NRGBA{m.Pix[i], m.Pix[i+1], m.Pix[i+2], 0xff}
+		}
+	}
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+// fitSize return the size which fits into maxWidth x maxHeight and keeps aspect ratio.
+// Zero or negative max value means no limit, image is never enlarged.
+func fitSize(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		if s := float64(maxHeight) / float64(height); s < scale {
+			scale = s
+		}
+	}
+	if scale == 1.0 {
+		return width, height
+	}
+	w, h := int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// resizeImage shrink image to fit into maxWidth x maxHeight, every target pixel is
+// the average of the source pixels it covers.
+func resizeImage(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := fitSize(srcW, srcH, maxWidth, maxHeight)
+	if dstW == srcW && dstH == srcH {
+		return img
+	}
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+		for y := 0; y < srcH; y++ {
+			for x := 0; x < srcW; x++ {
+				src.Set(x, y, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+			}
+		}
+	} else {
+		src = src.SubImage(bounds).(*image.RGBA)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for dy := 0; dy < dstH; dy++ {
+		y0, y1 := dy*srcH/dstH, (dy+1)*srcH/dstH
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < dstW; dx++ {
+			x0, x1 := dx*srcW/dstW, (dx+1)*srcW/dstW
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for y := y0; y < y1; y++ {
+				i := src.PixOffset(src.Rect.Min.X+x0, src.Rect.Min.Y+y)
+				for x := x0; x < x1; x++ {
+					r += uint32(src.Pix[i])
+					g += uint32(src.Pix[i+1])
+					b += uint32(src.Pix[i+2])
+					a += uint32(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			j := dst.PixOffset(dx, dy)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// imageContentType return mime type of format (png, jpeg, webp), empty if not supported
+func imageContentType(format string) string {
+	switch strings.ToLower(format) {
+	case "png":
+		return "image/png"
+	case "jpeg", "jpg":
+		return "image/jpeg"
+	case "webp":
+		return "image/webp"
+	}
+	return ""
+}
+
+// encodeImage encode img to w, quality is only used by jpeg (webp is always lossless)
+func encodeImage(w io.Writer, img image.Image, format string, quality int) error {
+	switch strings.ToLower(format) {
+	case "png":
+		encoder := &png.Encoder{CompressionLevel: png.BestSpeed}
+		return encoder.Encode(w, img)
+	case "jpeg", "jpg":
+		if quality <= 0 || quality > 100 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "webp":
+		return encodeWebP(w, img)
+	}
+	return errors.New("unsupported image format: " + format)
+}
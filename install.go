@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	installStatusDownloading = "downloading"
+	installStatusInstalling  = "installing"
+	installStatusLaunching   = "launching"
+	installStatusSuccess     = "success"
+	installStatusFailure     = "failure"
+	installStatusCanceled    = "canceled"
+)
+
+// apkInstaller parse, install and launch a downloaded apk, implemented by *APKManager
+type apkInstaller interface {
+	PackageName() (string, error)
+	ForceInstall() error
+	Start(opts StartOptions) error
+}
+
+// InstallManager download apk to device and install it in background
+type InstallManager struct {
+	*Background
+	newInstaller func(apkPath string) apkInstaller // replaced in tests to not run pm install
+}
+
+func NewInstallManager() *InstallManager {
+	return &InstallManager{
+		Background: NewBackground(),
+		newInstaller: func(apkPath string) apkInstaller {
+			return &APKManager{Path: apkPath}
+		},
+	}
+}
+
+// Install start a background install job and return its id, rawurl should be http or https
+func (m *InstallManager) Install(rawurl string, launch bool) (string, error) {
+	if rawurl == "" {
+		return "", errors.New("url is required")
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid url")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("invalid url " + strconv.Quote(rawurl) + ", should be http or https")
+	}
+	job := m.Go(installStatusDownloading, "downloading", func(ctx context.Context, job *BackgroundJob) {
+		m.installFromURL(ctx, job, rawurl, launch)
+	})
+	job.Set("url", rawurl)
+	return job.ID, nil
+}
+
+// InstallInfo is like job.Info, but with totalSize and copiedSize
+func InstallInfo(job *BackgroundJob) map[string]interface{} {
+	data := job.Info()
+	data["totalSize"], data["copiedSize"] = job.Progress.Sizes()
+	return data
+}
+
+func (m *InstallManager) installFromURL(ctx context.Context, job *BackgroundJob, url string, launch bool) {
+	dst := TempFileName(os.TempDir(), ".apk")
+	defer os.Remove(dst)
+
+	log.Printf("install[%s] download %s to %s", job.ID, url, dst)
+	if err := downloadFile(ctx, url, dst, job.Progress); err != nil {
+		if ctx.Err() != nil {
+			job.Finish(installStatusCanceled, "canceled", nil)
+		} else {
+			job.Finish(installStatusFailure, "download failed", err)
+		}
+		return
+	}
+
+	am := m.newInstaller(dst)
+	packageName, err := am.PackageName()
+	if err != nil {
+		job.Finish(installStatusFailure, "apk parse failed", err)
+		return
+	}
+	job.Set("packageName", packageName)
+
+	// pm install can not be interrupted, so this is the last chance to cancel
+	if ctx.Err() != nil {
+		job.Finish(installStatusCanceled, "canceled", nil)
+		return
+	}
+	job.Update(installStatusInstalling, "installing")
+	if err := am.ForceInstall(); err != nil {
+		job.Finish(installStatusFailure, "install failed", err)
+		return
+	}
+	if launch {
+		job.Update(installStatusLaunching, "launching")
+		if err := am.Start(StartOptions{}); err != nil {
+			job.Finish(installStatusFailure, "installed but launch failed", errors.Wrap(err, "launch"))
+			return
+		}
+	}
+	log.Printf("install[%s] %s installed", job.ID, packageName)
+	job.Finish(installStatusSuccess, "success installed", nil)
+}
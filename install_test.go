@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeInstaller record the steps instead of running pm install and am start
+type fakeInstaller struct {
+	mu         sync.Mutex
+	path       string
+	content    string // of the apk when installing
+	installErr error
+	launchErr  error
+	installed  bool
+	launched   bool
+	onInstall  func()
+}
+
+func (f *fakeInstaller) PackageName() (string, error) {
+	return "com.example.app", nil
+}
+
+func (f *fakeInstaller) ForceInstall() error {
+	if f.onInstall != nil {
+		f.onInstall()
+	}
+	data, _ := ioutil.ReadFile(f.path)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.content = string(data)
+	f.installed = f.installErr == nil
+	return f.installErr
+}
+
+func (f *fakeInstaller) Start(opts StartOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.launched = f.launchErr == nil
+	return f.launchErr
+}
+
+func newFakeInstallManager(fake *fakeInstaller) *InstallManager {
+	m := NewInstallManager()
+	m.newInstaller = func(apkPath string) apkInstaller {
+		fake.path = apkPath
+		return fake
+	}
+	return m
+}
+
+func waitInstallFinished(t *testing.T, m *InstallManager, id string) map[string]interface{} {
+	job, ok := m.Get(id)
+	if !assert.True(t, ok) {
+		return nil
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !job.Finished() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, job.Finished(), "install %s not finished", id)
+	return InstallInfo(job)
+}
+
+func TestInstallManagerInvalidURL(t *testing.T) {
+	m := newFakeInstallManager(&fakeInstaller{})
+	for _, rawurl := range []string{"", "some.apk", "ftp://some-host/some.apk", "http://", "http://%zz/some.apk"} {
+		_, err := m.Install(rawurl, false)
+		assert.Error(t, err, rawurl)
+	}
+	assert.Len(t, m.List(), 0)
+}
+
+func TestInstallManager(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/some.apk" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("apk content"))
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		name       string
+		url        string
+		launch     bool
+		installErr error
+		launchErr  error
+		status     string
+		message    string
+		installed  bool
+		launched   bool
+	}{
+		{"success", ts.URL + "/some.apk", false, nil, nil, installStatusSuccess, "success installed", true, false},
+		{"launch", ts.URL + "/some.apk", true, nil, nil, installStatusSuccess, "success installed", true, true},
+		{"download failed", ts.URL + "/404.apk", true, nil, nil, installStatusFailure, "download failed", false, false},
+		{"install failed", ts.URL + "/some.apk", true, errors.New("INSTALL_FAILED_OLDER_SDK"), nil, installStatusFailure, "install failed", false, false},
+		{"launch failed", ts.URL + "/some.apk", true, nil, errors.New("no activity"), installStatusFailure, "installed but launch failed", true, false},
+	} {
+		fake := &fakeInstaller{installErr: c.installErr, launchErr: c.launchErr}
+		m := newFakeInstallManager(fake)
+		fake.onInstall = func() {
+			assert.Equal(t, installStatusInstalling, m.List()[0].Status(), c.name)
+		}
+		id, err := m.Install(c.url, c.launch)
+		assert.NoError(t, err, c.name)
+		info := waitInstallFinished(t, m, id)
+		assert.Equal(t, c.status, info["status"], c.name)
+		assert.Equal(t, c.message, info["message"], c.name)
+		assert.Equal(t, c.url, info["url"], c.name)
+		assert.Equal(t, c.installed, fake.installed, c.name)
+		assert.Equal(t, c.launched, fake.launched, c.name)
+		if fake.path != "" {
+			assert.Equal(t, "apk content", fake.content, c.name)
+			assert.Equal(t, "com.example.app", info["packageName"], c.name)
+			_, err := os.Stat(fake.path)
+			assert.True(t, os.IsNotExist(err), "%s: temp apk should be removed", c.name)
+		}
+	}
+}
+
+func TestInstallManagerCancel(t *testing.T) {
+	started := make(chan bool)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	fake := &fakeInstaller{}
+	m := newFakeInstallManager(fake)
+	id, err := m.Install(ts.URL+"/some.apk", false)
+	assert.NoError(t, err)
+	<-started
+	job, _ := m.Get(id)
+	assert.Equal(t, installStatusDownloading, job.Status())
+	assert.NoError(t, m.Cancel(id))
+	info := waitInstallFinished(t, m, id)
+	assert.Equal(t, installStatusCanceled, info["status"])
+	assert.False(t, fake.installed)
+	assert.Error(t, m.Cancel(id), "finished job can not be canceled")
+}
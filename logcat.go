@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// LogEntry is a parsed line of logcat -v threadtime
+type LogEntry struct {
+	Time    string `json:"time"` // eg: 10-18 01:55:56.123
+	Pid     int    `json:"pid"`
+	Tid     int    `json:"tid"`
+	Level   string `json:"level"` // V, D, I, W, E, F
+	Tag     string `json:"tag"`
+	Message string `json:"message"`
+}
+
+// 10-18 01:55:56.123  1234  5678 I ActivityManager: Start proc 4321:com.example/u0a100
+var threadtimePattern = regexp.MustCompile(`^(\d\d-\d\d \d\d:\d\d:\d\d\.\d+)\s+(\d+)\s+(\d+)\s+([VDIWEFS])\s(.*?)\s*: (.*)$`)
+
+// parseThreadtime parse one line, ok is false for lines like: --------- beginning of main
+func parseThreadtime(line string) (entry LogEntry, ok bool) {
+	line = strings.TrimRight(line, "\r\n")
+	matches := threadtimePattern.FindStringSubmatch(line)
+	if matches == nil {
+		return entry, false
+	}
+	entry.Time = matches[1]
+	entry.Pid, _ = strconv.Atoi(matches[2])
+	entry.Tid, _ = strconv.Atoi(matches[3])
+	entry.Level = matches[4]
+	entry.Tag = matches[5]
+	entry.Message = matches[6]
+	return entry, true
+}
+
+var logLevels = map[string]int{"V": 0, "D": 1, "I": 2, "W": 3, "E": 4, "F": 5, "S": 6}
+
+// LogcatFilter is applied on server side, entry is sent when all the conditions match
+//   - tags: any of the tags
+//   - level: priority not lower than level
+//   - pids: any of the pids
+//   - pkg: the pid of the package, looked up again when the app restarted
+//   - regex: match message
+type LogcatFilter struct {
+	Tags  []string
+	Level string
+	Pids  []int
+	Pkg   string
+	Regex *regexp.Regexp
+
+	pkgPid       int
+	pkgCheckedAt time.Time
+}
+
+func parseLogcatFilter(form map[string][]string) (*LogcatFilter, error) {
+	get := func(name string) string {
+		if values := form[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	f := &LogcatFilter{
+		Tags:  form["tag"],
+		Level: strings.ToUpper(get("level")),
+		Pkg:   get("package"),
+	}
+	if len(f.Level) > 1 {
+		f.Level = f.Level[:1] // verbose, debug, info ...
+	}
+	if _, ok := logLevels[f.Level]; f.Level != "" && !ok {
+		return nil, fmt.Errorf("invalid level: %q, should be one of V, D, I, W, E, F", get("level"))
+	}
+	for _, s := range form["pid"] {
+		pid, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid: %q", s)
+		}
+		f.Pids = append(f.Pids, pid)
+	}
+	if expr := get("regex"); expr != "" {
+		var err error
+		if f.Regex, err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// packagePid return pid of package, which is cached for 2 seconds
+func (f *LogcatFilter) packagePid() int {
+	if time.Since(f.pkgCheckedAt) > 2*time.Second {
+		f.pkgPid, _ = pidOf(f.Pkg)
+		f.pkgCheckedAt = time.Now()
+	}
+	return f.pkgPid
+}
+
+func (f *LogcatFilter) Match(entry LogEntry) bool {
+	if f.Level != "" && logLevels[entry.Level] < logLevels[f.Level] {
+		return false
+	}
+	if len(f.Tags) > 0 && !containsString(f.Tags, entry.Tag) {
+		return false
+	}
+	if len(f.Pids) > 0 {
+		found := false
+		for _, pid := range f.Pids {
+			found = found || pid == entry.Pid
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Pkg != "" && f.packagePid() != entry.Pid {
+		return false
+	}
+	if f.Regex != nil && !f.Regex.MatchString(entry.Message) {
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var logcatBuffers = []string{"main", "system", "radio", "events", "crash", "kernel", "all"}
+
+// logcatArgs build logcat command from query: buffer (comma separated) and tail (lines of history, default 100)
+func logcatArgs(form map[string][]string) ([]string, error) {
+	args := []string{"logcat", "-v", "threadtime"}
+	if values := form["buffer"]; len(values) > 0 && values[0] != "" {
+		for _, name := range strings.Split(values[0], ",") {
+			if !containsString(logcatBuffers, name) {
+				return nil, fmt.Errorf("invalid buffer: %q", name)
+			}
+			args = append(args, "-b", name)
+		}
+	}
+	tail := 100
+	if values := form["tail"]; len(values) > 0 && values[0] != "" {
+		var err error
+		if tail, err = strconv.Atoi(values[0]); err != nil || tail <= 0 {
+			return nil, fmt.Errorf("invalid tail: %q, should be positive", values[0])
+		}
+	}
+	return append(args, "-T", strconv.Itoa(tail)), nil
+}
+
+// readLogcat parse logcat output and send matched entries to send, until rd closed or send fail
+func readLogcat(rd io.Reader, filter *LogcatFilter, send func(LogEntry) error) error {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry, ok := parseThreadtime(scanner.Text())
+		if !ok || !filter.Match(entry) {
+			continue
+		}
+		if err := send(entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// handleLogcat stream logcat as websocket text messages, or server-sent events when not a websocket request.
+// Logs kept by logcatCollector are exported instead when since, until or mark is given.
+//
+//	$ curl -N "$DEVICE_URL/logcat?level=W&tag=ActivityManager&package=com.example&regex=crash"
+func handleLogcat(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	filter, err := parseLogcatFilter(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("since") != "" || r.Form.Get("until") != "" || r.Form.Get("mark") != "" {
+		exportLogcat(w, r, filter)
+		return
+	}
+	args, err := logcatArgs(r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+	}
+	defer stop()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		go func() {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					stop() // client closed, stdout is closed and readLogcat returns
+					return
+				}
+			}
+		}()
+		err = readLogcat(stdout, filter, func(entry LogEntry) error {
+			ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			return ws.WriteJSON(entry)
+		})
+	} else {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher.Flush()
+		go func() {
+			<-r.Context().Done()
+			stop()
+		}()
+		err = readLogcat(stdout, filter, func(entry LogEntry) error {
+			data, _ := json.Marshal(entry)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		})
+	}
+	log.Printf("logcat stream %s finished: %v", r.RemoteAddr, err)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThreadtime(t *testing.T) {
+	entry, ok := parseThreadtime("10-18 01:55:56.123  1234  5678 I ActivityManager: Start proc 4321:com.example/u0a100\r\n")
+	assert.True(t, ok)
+	assert.Equal(t, LogEntry{
+		Time:    "10-18 01:55:56.123",
+		Pid:     1234,
+		Tid:     5678,
+		Level:   "I",
+		Tag:     "ActivityManager",
+		Message: "Start proc 4321:com.example/u0a100",
+	}, entry)
+
+	entry, ok = parseThreadtime("10-18 01:55:56.123   100   100 W chatty  : uid=1000 expire 3 lines: a: b")
+	assert.True(t, ok)
+	assert.Equal(t, "chatty", entry.Tag)
+	assert.Equal(t, "uid=1000 expire 3 lines: a: b", entry.Message)
+
+	_, ok = parseThreadtime("--------- beginning of main")
+	assert.False(t, ok)
+}
+
+func TestLogcatFilter(t *testing.T) {
+	_, err := parseLogcatFilter(url.Values{"level": {"X"}})
+	assert.Error(t, err)
+	_, err = parseLogcatFilter(url.Values{"pid": {"abc"}})
+	assert.Error(t, err)
+	_, err = parseLogcatFilter(url.Values{"regex": {"("}})
+	assert.Error(t, err)
+
+	f, err := parseLogcatFilter(url.Values{"level": {"warn"}, "tag": {"A", "B"}, "pid": {"1", "2"}, "regex": {"^crash"}})
+	assert.NoError(t, err)
+	assert.True(t, f.Match(LogEntry{Level: "E", Tag: "B", Pid: 2, Message: "crash here"}))
+	assert.False(t, f.Match(LogEntry{Level: "I", Tag: "B", Pid: 2, Message: "crash here"}))
+	assert.False(t, f.Match(LogEntry{Level: "E", Tag: "C", Pid: 2, Message: "crash here"}))
+	assert.False(t, f.Match(LogEntry{Level: "E", Tag: "B", Pid: 3, Message: "crash here"}))
+	assert.False(t, f.Match(LogEntry{Level: "E", Tag: "B", Pid: 2, Message: "no crash"}))
+
+	f, _ = parseLogcatFilter(url.Values{})
+	assert.True(t, f.Match(LogEntry{Level: "V"}))
+}
+
+func TestLogcatArgs(t *testing.T) {
+	args, err := logcatArgs(url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"logcat", "-v", "threadtime", "-T", "100"}, args)
+
+	args, err = logcatArgs(url.Values{"buffer": {"main,crash"}, "tail": {"10"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"logcat", "-v", "threadtime", "-b", "main", "-b", "crash", "-T", "10"}, args)
+
+	_, err = logcatArgs(url.Values{"buffer": {"foo"}})
+	assert.Error(t, err)
+	_, err = logcatArgs(url.Values{"tail": {"0"}})
+	assert.Error(t, err)
+}
+
+func TestReadLogcat(t *testing.T) {
+	input := strings.Join([]string{
+		"--------- beginning of main",
+		"10-18 01:55:56.123  1234  5678 I Foo     : hello",
+		"10-18 01:55:56.124  1234  5678 E Bar     : world",
+	}, "\n")
+	f, _ := parseLogcatFilter(url.Values{"level": {"E"}})
+	var entries []LogEntry
+	err := readLogcat(strings.NewReader(input), f, func(entry LogEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "Bar", entries[0].Tag)
+		assert.Equal(t, "world", entries[0].Message)
+	}
+}
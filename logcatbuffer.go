@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openatx/atx-agent/cmdctrl"
+	"github.com/pkg/errors"
+)
+
+const (
+	logcatDir         = "/data/local/tmp/atx-logcat"
+	logcatSegmentSize = 4 << 20 // 4MB
+	logcatMaxSegments = 8       // the oldest segment is deleted when exceeded
+	logcatMaxMarks    = 1000
+)
+
+var logcatCollector = NewLogcatCollector(logcatDir, logcatSegmentSize, logcatMaxSegments)
+
+// LogcatMark is a named moment created by POST /logcat/marks
+type LogcatMark struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// LogcatCollector keep the output of a long running logcat in a ring of segment files.
+// Every line is stored as "<unix milliseconds> <threadtime line>", the time is parsed from the line,
+// so a slice between two moments can be exported later.
+type LogcatCollector struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	maxSegments int
+	loaded      bool
+	segments    []int // index of segment files, oldest first
+	file        *os.File
+	size        int64
+	partial     []byte // incomplete line of the last Write
+
+	// logcat is restarted with -T lastTime, lines of lastTime already stored are skipped
+	lastTime  string
+	lastLines map[string]bool
+	resume    map[string]bool
+
+	marks []LogcatMark
+}
+
+func NewLogcatCollector(dir string, segmentSize int64, maxSegments int) *LogcatCollector {
+	return &LogcatCollector{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSegments: maxSegments,
+	}
+}
+
+// ServiceInfo for cmdctrl, logcat output is written to the collector
+func (c *LogcatCollector) ServiceInfo() cmdctrl.CommandInfo {
+	return cmdctrl.CommandInfo{
+		ArgsFunc:        c.nextArgs,
+		Stdout:          c,
+		MaxRetries:      3,
+		RecoverDuration: 30 * time.Second,
+		NextLaunchWait:  time.Second,
+		OnStop:          c.Close,
+	}
+}
+
+func (c *LogcatCollector) nextArgs() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.partial = nil
+	args := []string{"logcat", "-v", "threadtime"}
+	if c.lastTime != "" {
+		c.resume = c.lastLines
+		args = append(args, "-T", c.lastTime)
+	}
+	return args, nil
+}
+
+func (c *LogcatCollector) segmentPath(index int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%08d.log", index))
+}
+
+// load find segments left by the last run, and the time to continue from
+func (c *LogcatCollector) load() error {
+	if c.loaded {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(c.dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	c.segments = nil
+	for _, name := range names {
+		index, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".log"))
+		if err == nil {
+			c.segments = append(c.segments, index)
+		}
+	}
+	sort.Ints(c.segments)
+	if n := len(c.segments); n > 0 {
+		f, err := os.Open(c.segmentPath(c.segments[n-1]))
+		if err == nil {
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				if _, line, ok := splitLogcatRecord(scanner.Text()); ok {
+					entry, _ := parseThreadtime(line)
+					c.remember(entry.Time, line)
+				}
+			}
+			f.Close()
+		}
+	}
+	c.loaded = true
+	return nil
+}
+
+func (c *LogcatCollector) remember(logTime, line string) {
+	if logTime != c.lastTime {
+		c.lastTime = logTime
+		c.lastLines = make(map[string]bool)
+	}
+	c.lastLines[line] = true
+}
+
+// Write is called with logcat output, lines are split and stored. Errors are logged and the data is dropped,
+// so that logcat keeps running.
+func (c *LogcatCollector) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(); err != nil {
+		log.Println("logcat collector:", err)
+		return len(p), nil
+	}
+	data := append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(data[:i]), "\r")
+		data = data[i+1:]
+		if err := c.writeLine(line, time.Now()); err != nil {
+			log.Println("logcat collector:", err)
+		}
+	}
+	c.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+func (c *LogcatCollector) writeLine(line string, now time.Time) error {
+	entry, ok := parseThreadtime(line)
+	if !ok {
+		return nil // eg: --------- beginning of main
+	}
+	if c.resume != nil {
+		if entry.Time == c.lastTime && c.resume[line] {
+			return nil
+		}
+		c.resume = nil
+	}
+	record := fmt.Sprintf("%d %s\n", logcatTime(entry.Time, now).UnixNano()/int64(time.Millisecond), line)
+	if err := c.prepareSegment(int64(len(record))); err != nil {
+		return err
+	}
+	n, err := io.WriteString(c.file, record)
+	c.size += int64(n)
+	if err != nil {
+		return err
+	}
+	c.remember(entry.Time, line)
+	return nil
+}
+
+// prepareSegment make sure the current segment has space for n bytes, a new segment is started when full
+func (c *LogcatCollector) prepareSegment(n int64) error {
+	if c.file != nil {
+		if c.size+n <= c.segmentSize {
+			return nil
+		}
+		c.file.Close()
+		c.file = nil
+	} else if len(c.segments) > 0 {
+		// continue the last segment after restarted
+		f, err := os.OpenFile(c.segmentPath(c.segments[len(c.segments)-1]), os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			finfo, err := f.Stat()
+			if err == nil && finfo.Size()+n <= c.segmentSize {
+				c.file, c.size = f, finfo.Size()
+				return nil
+			}
+			f.Close()
+		}
+	}
+	index := 0
+	if len(c.segments) > 0 {
+		index = c.segments[len(c.segments)-1] + 1
+	}
+	f, err := os.OpenFile(c.segmentPath(index), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	c.file, c.size = f, 0
+	c.segments = append(c.segments, index)
+	for len(c.segments) > c.maxSegments {
+		os.Remove(c.segmentPath(c.segments[0]))
+		c.segments = c.segments[1:]
+	}
+	return nil
+}
+
+// Close the current segment, called when logcat stopped
+func (c *LogcatCollector) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// AddMark remember the current time with name, names can be reused and the latest one is used
+func (c *LogcatCollector) AddMark(name string) (LogcatMark, error) {
+	if name == "" {
+		return LogcatMark{}, errors.New("mark name is required")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mark := LogcatMark{Name: name, Time: time.Now()}
+	c.marks = append(c.marks, mark)
+	if over := len(c.marks) - logcatMaxMarks; over > 0 {
+		c.marks = append([]LogcatMark(nil), c.marks[over:]...)
+	}
+	return mark, nil
+}
+
+// Marks return all the marks, oldest first
+func (c *LogcatCollector) Marks() []LogcatMark {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]LogcatMark{}, c.marks...)
+}
+
+// MarkRange return the time of the mark, and the time of the next mark (zero if it is the latest)
+func (c *LogcatCollector) MarkRange(name string) (since, until time.Time, ok bool) {
+	marks := c.Marks()
+	for i := len(marks) - 1; i >= 0; i-- {
+		if marks[i].Name != name {
+			continue
+		}
+		if i+1 < len(marks) {
+			until = marks[i+1].Time
+		}
+		return marks[i].Time, until, true
+	}
+	return
+}
+
+// ParseTime accept RFC3339, unix seconds (eg: 1697594156.123) or a mark name
+func (c *LogcatCollector) ParseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	if since, _, ok := c.MarkRange(s); ok {
+		return since, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %q, should be RFC3339, unix seconds or a mark name", s)
+}
+
+// Export write stored lines logged in [since, until) which match filter. Zero since or until means no limit.
+// format is text (the original threadtime lines) or ndjson
+func (c *LogcatCollector) Export(w io.Writer, since, until time.Time, filter *LogcatFilter, format string) error {
+	c.mu.Lock()
+	paths := make([]string, 0, len(c.segments))
+	for _, index := range c.segments {
+		paths = append(paths, c.segmentPath(index))
+	}
+	c.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	for _, p := range paths {
+		if finfo, err := os.Stat(p); err != nil || (!since.IsZero() && finfo.ModTime().Before(since)) {
+			continue // removed by rotation, or nothing new since
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		for _, record := range strings.Split(string(data), "\n") {
+			t, line, ok := splitLogcatRecord(record)
+			if !ok || (!since.IsZero() && t.Before(since)) || (!until.IsZero() && !t.Before(until)) {
+				continue
+			}
+			entry, ok := parseThreadtime(line)
+			if !ok || !filter.Match(entry) {
+				continue
+			}
+			if format == "ndjson" {
+				err = enc.Encode(entry)
+			} else {
+				_, err = io.WriteString(w, line+"\n")
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func splitLogcatRecord(record string) (t time.Time, line string, ok bool) {
+	i := strings.IndexByte(record, ' ')
+	if i < 0 {
+		return
+	}
+	ms, err := strconv.ParseInt(record[:i], 10, 64)
+	if err != nil {
+		return
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), record[i+1:], true
+}
+
+// logcatTime parse threadtime time (eg: 10-18 01:55:56.123) which has no year,
+// the year of now is used, and last year if the time is in the future
+func logcatTime(s string, now time.Time) time.Time {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", strconv.Itoa(now.Year())+"-"+s, time.Local)
+	if err != nil {
+		return now
+	}
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+// exportLogcat handle GET /logcat with since, until or mark
+//
+//	$ curl "$DEVICE_URL/logcat?mark=test_login&format=ndjson"
+func exportLogcat(w http.ResponseWriter, r *http.Request, filter *LogcatFilter) {
+	format := r.FormValue("format")
+	if format != "" && format != "text" && format != "ndjson" {
+		renderJSONError(w, http.StatusBadRequest, "invalid format: "+format+", should be text or ndjson")
+		return
+	}
+	var since, until time.Time
+	if name := r.FormValue("mark"); name != "" {
+		var ok bool
+		if since, until, ok = logcatCollector.MarkRange(name); !ok {
+			renderJSONError(w, http.StatusNotFound, "mark not found: "+name)
+			return
+		}
+	}
+	var err error
+	if s := r.FormValue("since"); s != "" {
+		if since, err = logcatCollector.ParseTime(s); err != nil {
+			renderJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if s := r.FormValue("until"); s != "" {
+		if until, err = logcatCollector.ParseTime(s); err != nil {
+			renderJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	if err := logcatCollector.Export(w, since, until, filter, format); err != nil {
+		log.Println("logcat export:", err)
+	}
+}
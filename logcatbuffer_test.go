@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func threadtimeLine(t time.Time, tag, message string) string {
+	return fmt.Sprintf("%s  1234  5678 I %s: %s", t.Format("01-02 15:04:05.000"), tag, message)
+}
+
+func TestLogcatTime(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 10, 0, time.Local)
+	assert.Equal(t, time.Date(2026, 1, 1, 0, 0, 5, 123000000, time.Local), logcatTime("01-01 00:00:05.123", now))
+	assert.Equal(t, time.Date(2025, 12, 31, 23, 59, 59, 0, time.Local), logcatTime("12-31 23:59:59.000", now))
+	assert.Equal(t, now, logcatTime("bad", now))
+}
+
+func TestLogcatCollectorExport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logcat")
+	defer os.RemoveAll(dir)
+	c := NewLogcatCollector(dir, 1<<20, 2)
+
+	base := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	input := strings.Join([]string{
+		"--------- beginning of main",
+		threadtimeLine(base, "A", "one"),
+		threadtimeLine(base.Add(time.Second), "B", "two"),
+		threadtimeLine(base.Add(2*time.Second), "A", "three"),
+	}, "\n") + "\n"
+	// written in pieces, lines are split across writes
+	c.Write([]byte(input[:40]))
+	c.Write([]byte(input[40:]))
+
+	all, _ := parseLogcatFilter(nil)
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, c.Export(buf, base.Add(time.Second), time.Time{}, all, "text"))
+	assert.Equal(t, threadtimeLine(base.Add(time.Second), "B", "two")+"\n"+threadtimeLine(base.Add(2*time.Second), "A", "three")+"\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, c.Export(buf, time.Time{}, base.Add(2*time.Second), all, "text"))
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	buf.Reset()
+	f, _ := parseLogcatFilter(map[string][]string{"tag": {"A"}})
+	assert.NoError(t, c.Export(buf, time.Time{}, time.Time{}, f, "ndjson"))
+	assert.Contains(t, buf.String(), `"message":"one"`)
+	assert.Contains(t, buf.String(), `"message":"three"`)
+	assert.NotContains(t, buf.String(), `"message":"two"`)
+	c.Close()
+
+	// restarted with -T from the last line, lines already stored are skipped
+	c = NewLogcatCollector(dir, 1<<20, 2)
+	args, err := c.nextArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"logcat", "-v", "threadtime", "-T", base.Add(2 * time.Second).Format("01-02 15:04:05.000")}, args)
+	c.Write([]byte(threadtimeLine(base.Add(2*time.Second), "A", "three") + "\n" + threadtimeLine(base.Add(3*time.Second), "A", "four") + "\n"))
+	buf.Reset()
+	assert.NoError(t, c.Export(buf, time.Time{}, time.Time{}, all, "text"))
+	assert.Equal(t, 4, strings.Count(buf.String(), "\n"))
+	c.Close()
+}
+
+func TestLogcatCollectorRotate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logcat")
+	defer os.RemoveAll(dir)
+	c := NewLogcatCollector(dir, 200, 2)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		c.Write([]byte(threadtimeLine(now, "Tag", fmt.Sprintf("message %d", i)) + "\n"))
+	}
+	c.Close()
+	names, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	assert.Len(t, names, 2)
+
+	all, _ := parseLogcatFilter(nil)
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, c.Export(buf, time.Time{}, time.Time{}, all, "text"))
+	assert.NotContains(t, buf.String(), "message 0")
+	assert.Contains(t, buf.String(), "message 9")
+}
+
+func TestLogcatMarks(t *testing.T) {
+	c := NewLogcatCollector("", 0, 0)
+	_, err := c.AddMark("")
+	assert.Error(t, err)
+
+	start, _ := c.AddMark("start")
+	time.Sleep(time.Millisecond)
+	stop, _ := c.AddMark("stop")
+
+	since, until, ok := c.MarkRange("start")
+	assert.True(t, ok)
+	assert.Equal(t, start.Time, since)
+	assert.Equal(t, stop.Time, until)
+
+	_, until, ok = c.MarkRange("stop")
+	assert.True(t, ok)
+	assert.True(t, until.IsZero())
+
+	_, _, ok = c.MarkRange("missing")
+	assert.False(t, ok)
+
+	tm, err := c.ParseTime("stop")
+	assert.NoError(t, err)
+	assert.Equal(t, stop.Time, tm)
+	tm, err = c.ParseTime("1500000000.5")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500000000500), tm.UnixNano()/int64(time.Millisecond))
+	_, err = c.ParseTime("2017-07-14T02:40:00Z")
+	assert.NoError(t, err)
+	_, err = c.ParseTime("nope")
+	assert.Error(t, err)
+	assert.Len(t, c.Marks(), 2)
+}
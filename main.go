@@ -4,6 +4,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -286,20 +287,41 @@ func stopSelf() {
 	// kill previous daemon first
 	log.Println("stop server self")
 
-	listenPort, _ := strconv.Atoi(strings.Split(listenAddr, ":")[1])
-	client := http.Client{Timeout: 3 * time.Second}
-	_, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/stop", listenPort))
-	if err == nil {
+	token := ""
+	if authenticator != nil {
+		token = authenticator.AnyToken()
+	}
+	if err := requestStop(listenAddr, token); err == nil {
 		log.Println("wait server stopped")
 		time.Sleep(500 * time.Millisecond) // server will quit in 0.5s
 	} else {
-		log.Println("already stopped")
+		log.Println("already stopped:", err)
 	}
 
 	// to make sure stopped
 	killAgentProcess()
 }
 
+// requestStop call /stop of the server listening on addr with plain http from loopback,
+// which is allowed even if client certificates are required
+func requestStop(addr string, token string) error {
+	listenPort, _ := strconv.Atoi(addr[strings.LastIndex(addr, ":")+1:])
+	client := http.Client{Timeout: 3 * time.Second}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/stop", listenPort), nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stop: http status %s", resp.Status)
+	}
+	return nil
+}
+
 func init() {
 	syslog.SetFlags(syslog.Lshortfile | syslog.LstdFlags)
 
@@ -395,6 +417,18 @@ func main() {
 	cmdServer.Flag("log", "log file path when in daemon mode").StringVar(&daemonLogPath)
 	// fServerURL := cmdServer.Flag("server", "server url").Short('t').String()
 	fNoUiautomator := cmdServer.Flag("nouia", "do not start uiautoamtor when start").Bool()
+	fNoLogcat := cmdServer.Flag("nologcat", "do not collect logcat in background").Bool()
+	cmdServer.Flag("assets", "directory of prebuilt minicap and minitouch").Default(assetsDir).StringVar(&assetsDir)
+	cmdServer.Flag("token", "token required to access the api, can be used multiple times").StringsVar(&authTokens)
+	cmdServer.Flag("token-file", "file contains tokens, one per line").StringVar(&authTokenFile)
+	cmdServer.Flag("auth-allow", "path can be accessed without token, ends with / to allow all sub paths, \"GET /path\" to allow only GET").StringsVar(&authAllowPaths)
+	cmdServer.Flag("fs-root", "only files under the root can be accessed by /raw, /upload, /finfo, can be used multiple times").StringsVar(&fsRoots)
+	cmdServer.Flag("tls", "serve https, a self-signed certificate is generated when --tls-cert not set").BoolVar(&tlsEnabled)
+	cmdServer.Flag("tls-cert", "PEM certificate file for https").StringVar(&tlsCertFile)
+	cmdServer.Flag("tls-key", "PEM private key file for https").StringVar(&tlsKeyFile)
+	cmdServer.Flag("tls-client-ca", "PEM CA file to verify client certificates (mutual TLS)").StringVar(&tlsClientCAFile)
+	cmdServer.Flag("upgrade-url", "base url to download new version for /upgrade").StringVar(&upgradeBaseURL)
+	cmdServer.Flag("upgrade-pubkey", "PEM public key file to verify signature of new version").StringVar(&upgradePublicKeyPath)
 
 	// CMD: version
 	kingpin.Command("version", "show version")
@@ -429,6 +463,25 @@ func main() {
 		// continue
 	}
 
+	var err error
+	authenticator, err = NewAuthenticator(authTokens, authTokenFile, authAllowPaths)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fsSandbox, err = NewSandbox(fsRoots); err != nil {
+		log.Fatal(err)
+	}
+	var tlsConfig *tls.Config
+	if tlsEnabled || tlsCertFile != "" || tlsClientCAFile != "" {
+		if tlsConfig, tlsInfo, err = loadTLSConfig(tlsCertFile, tlsKeyFile, tlsClientCAFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("https enabled, certificate fingerprint %s", tlsInfo.Fingerprint)
+	}
+	if !authenticator.Enabled() {
+		log.Println("WARNING: no token configured, everyone in the network can access atx-agent")
+	}
+
 	if *fStop {
 		stopSelf()
 		if !*fDaemon {
@@ -470,6 +523,9 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if tlsConfig != nil {
+		listener = newTLSListener(listener, tlsConfig)
+	}
 
 
 	// uiautomator 2.0
@@ -498,6 +554,11 @@ func main() {
 		},
 	})
 
+	service.Add("minicap", minicap.ServiceInfo())
+	service.Add("minitouch", minitouch.ServiceInfo())
+	service.Add("screenrecord", screenRecorder.ServiceInfo())
+	service.Add("logcat", logcatCollector.ServiceInfo())
+
 	// stop uiautomator when 3 minutes not requests
 	go func() {
 		for range uiautomatorTimer.C {
@@ -511,8 +572,16 @@ func main() {
 			log.Println("uiautomator start failed:", err)
 		}
 	}
+	if !*fNoLogcat {
+		if err := service.Start("logcat"); err != nil {
+			log.Println("logcat collector start failed:", err)
+		}
+	}
 
 	server := NewServer()
+	if tlsConfig != nil && tlsConfig.ClientAuth != tls.NoClientCert {
+		server.httpServer.Handler = requireClientCert(server.httpServer.Handler)
+	}
 
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
@@ -542,4 +611,7 @@ func main() {
 	if err := server.Serve(listener); err != nil {
 		log.Println("server quit:", err)
 	}
+	if server.upgrade != nil {
+		restartAfterUpgrade(server.upgrade)
+	}
 }
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openatx/atx-agent/cmdctrl"
+	"github.com/pkg/errors"
+)
+
+// assetsDir contains prebuilt minicap and minitouch, set by: server --assets
+// Layout is the same as npm package minicap-prebuilt and minitouch-prebuilt
+//
+//	{assetsDir}/minicap/{abi}/bin/minicap
+//	{assetsDir}/minicap/{abi}/bin/minicap-nopie              (sdk < 16)
+//	{assetsDir}/minicap/{abi}/lib/android-{sdk}/minicap.so
+var assetsDir = "/data/local/tmp/atx-assets"
+
+const (
+	minicapBinPath    = "/data/local/tmp/minicap"
+	minicapSoPath     = "/data/local/tmp/minicap.so"
+	minicapSocketName = "minicap" // abstract unix socket: @minicap
+
+	// minicap is not used for a while after it crashed repeatedly
+	minicapDisableDuration = 10 * time.Minute
+)
+
+var (
+	errMinicapUnavailable = errors.New("minicap is not available")
+	errRotationChanged    = errors.New("rotation changed")
+)
+
+// deviceABIs return supported abis, the preferred one first
+func deviceABIs() []string {
+	if abilist := getCachedProperty("ro.product.cpu.abilist"); abilist != "" {
+		return strings.Split(abilist, ",")
+	}
+	return []string{getCachedProperty("ro.product.cpu.abi")}
+}
+
+// deployAsset copy src to dst when content differs
+func deployAsset(src, dst string) error {
+	srcSum, err := fileHexDigest(src, "md5")
+	if err != nil {
+		return err
+	}
+	if dstSum, err := fileHexDigest(dst, "md5"); err == nil && dstSum == srcSum {
+		return nil
+	}
+	log.Printf("deploy %s -> %s", src, dst)
+	return copyFileAtomic(src, dst, 0755)
+}
+
+type minicapInfo struct {
+	Width    int `json:"width"`
+	Height   int `json:"height"`
+	Rotation int `json:"rotation"`
+}
+
+type Minicap struct {
+	mu            sync.Mutex
+	checked       bool
+	info          minicapInfo
+	err           error // install or probe error
+	stopping      bool
+	disabledUntil time.Time
+}
+
+var minicap = &Minicap{}
+
+func (m *Minicap) assetPaths() (bin string, so string, err error) {
+	sdk, _ := strconv.Atoi(getCachedProperty("ro.build.version.sdk"))
+	binName := "minicap"
+	if sdk < 16 {
+		binName = "minicap-nopie"
+	}
+	for _, abi := range deviceABIs() {
+		abi = strings.TrimSpace(abi)
+		bin = filepath.Join(assetsDir, "minicap", abi, "bin", binName)
+		so = filepath.Join(assetsDir, "minicap", abi, "lib", "android-"+strconv.Itoa(sdk), "minicap.so")
+		if fileExists(bin) && fileExists(so) {
+			return bin, so, nil
+		}
+	}
+	return "", "", fmt.Errorf("minicap for abi %v sdk %d not found in %s", deviceABIs(), sdk, assetsDir)
+}
+
+func (m *Minicap) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(minicapBinPath, args...)
+	cmd.Env = append(os.Environ(), "LD_LIBRARY_PATH="+filepath.Dir(minicapSoPath))
+	return cmd
+}
+
+// Install deploy minicap from assetsDir and check whether it works
+func (m *Minicap) Install() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checked = true
+	m.disabledUntil = time.Time{}
+	m.err = m.install()
+	if m.err != nil {
+		log.Println("minicap unavailable:", m.err)
+	}
+	return m.err
+}
+
+func (m *Minicap) install() error {
+	bin, so, err := m.assetPaths()
+	if err != nil {
+		return err
+	}
+	if err := deployAsset(bin, minicapBinPath); err != nil {
+		return errors.Wrap(err, "deploy minicap")
+	}
+	if err := deployAsset(so, minicapSoPath); err != nil {
+		return errors.Wrap(err, "deploy minicap.so")
+	}
+	output, err := m.command("-i").Output()
+	if err != nil {
+		return errors.Wrap(err, "minicap -i")
+	}
+	if err := json.Unmarshal(output, &m.info); err != nil {
+		return errors.Wrap(err, "minicap -i")
+	}
+	if m.info.Width == 0 || m.info.Height == 0 {
+		return errors.New("minicap -i: invalid display size")
+	}
+	return nil
+}
+
+// Available return true when minicap is installed and not crashed recently
+func (m *Minicap) Available() bool {
+	m.mu.Lock()
+	checked := m.checked
+	m.mu.Unlock()
+	if !checked {
+		m.Install()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err == nil && time.Now().After(m.disabledUntil)
+}
+
+// projection return minicap -P argument, image is limited by displayMaxWidthHeight
+func (m *Minicap) projection(maxSize int) string {
+	m.mu.Lock()
+	info := m.info
+	m.mu.Unlock()
+	w, h := fitSize(info.Width, info.Height, maxSize, maxSize)
+	return fmt.Sprintf("%dx%d@%dx%d/%d", info.Width, info.Height, w, h, deviceRotation)
+}
+
+// Screenshot return a jpeg of real display size
+func (m *Minicap) Screenshot() ([]byte, error) {
+	if !m.Available() {
+		return nil, errMinicapUnavailable
+	}
+	output, err := m.command("-P", m.projection(0), "-s").Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "minicap")
+	}
+	if !bytes.HasPrefix(output, []byte("\xff\xd8")) {
+		return nil, ErrJpegWrongFormat
+	}
+	return output, nil
+}
+
+// ServiceInfo for cmdctrl, minicap stream jpeg to unix socket @minicap
+func (m *Minicap) ServiceInfo() cmdctrl.CommandInfo {
+	return cmdctrl.CommandInfo{
+		Environ: []string{"LD_LIBRARY_PATH=" + filepath.Dir(minicapSoPath)},
+		ArgsFunc: func() ([]string, error) {
+			if !m.Available() {
+				return nil, errMinicapUnavailable
+			}
+			return []string{minicapBinPath, "-S", "-P", m.projection(displayMaxWidthHeight)}, nil
+		},
+		MaxRetries: 3,
+		OnStart: func() error {
+			m.mu.Lock()
+			m.stopping = false
+			m.mu.Unlock()
+			return nil
+		},
+		OnStop: func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if !m.stopping && m.err == nil {
+				// cmdctrl give up after MaxRetries
+				log.Printf("minicap crashed repeatedly, disabled for %v", minicapDisableDuration)
+				m.disabledUntil = time.Now().Add(minicapDisableDuration)
+			}
+		},
+	}
+}
+
+// StopService stop minicap service, which is not treated as crash
+func (m *Minicap) StopService() {
+	m.mu.Lock()
+	m.stopping = true
+	m.mu.Unlock()
+	service.Stop("minicap", true)
+}
+
+func (m *Minicap) RestartService() error {
+	m.StopService()
+	return service.Start("minicap")
+}
+
+// readSocket send frames from @minicap to dataC, until quitC closed (return nil) or rotation changed
+func (m *Minicap) readSocket(dataC chan []byte, quitC chan bool, rotationC chan interface{}) error {
+	for retries := 0; ; retries++ {
+		conn, err := net.Dial("unix", "@"+minicapSocketName)
+		if err != nil {
+			if retries > 10 || !service.Running("minicap") {
+				return errors.Wrap(err, "dial @"+minicapSocketName)
+			}
+			select {
+			case <-quitC:
+				return nil
+			case <-time.After(500 * time.Millisecond):
+			}
+			continue
+		}
+		retries = 0
+		stopC := make(chan bool)
+		errC := GoFunc(func() error {
+			return translateMinicap(conn, dataC, stopC)
+		})
+		select {
+		case err = <-errC:
+			conn.Close()
+			if !service.Running("minicap") {
+				return err
+			}
+			log.Println("minicap read error, try to read again:", err)
+			continue
+		case <-quitC:
+			err = nil
+		case <-rotationC:
+			err = errRotationChanged
+		}
+		close(stopC)
+		conn.Close()
+		<-errC
+		return err
+	}
+}
+
+// translateMinicap read frames from minicap socket and send jpeg to dataC
+// Protocol: https://github.com/openstf/minicap#usage
+func translateMinicap(conn net.Conn, dataC chan []byte, quitC chan bool) error {
+	var pid, rw, rh, vw, vh uint32
+	var version, unused, orientation, quirkFlag uint8
+	rd := &errorBinaryReader{rd: conn}
+	rd.ReadInto(&version, &unused, &pid, &rw, &rh, &vw, &vh, &orientation, &quirkFlag)
+	if rd.err != nil {
+		return rd.err
+	}
+	log.Printf("minicap banner: pid=%d real=%dx%d virtual=%dx%d orientation=%d", pid, rw, rh, vw, vh, orientation)
+	for {
+		var size uint32
+		if err := rd.ReadInto(&size); err != nil {
+			return err
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(frame, []byte("\xff\xd8")) {
+			return ErrJpegWrongFormat
+		}
+		select {
+		case dataC <- frame:
+		case <-quitC:
+			return nil
+		}
+	}
+}
+
+// streamScreen send jpeg frames and text messages to dataC until quitC closed.
+// minicap is used when available, fallback to screencap when it is not or crashed repeatedly
+func streamScreen(dataC chan []byte, quitC chan bool) {
+	defer close(dataC)
+	send := func(data []byte) bool {
+		select {
+		case dataC <- data:
+			return true
+		case <-quitC:
+			return false
+		}
+	}
+	rotationC, cancel := subscribeRotation()
+	defer cancel()
+	defer minicap.StopService()
+
+	failures := 0 // give up minicap after failed too many times
+	for {
+		if failures < 3 && minicap.Available() {
+			if !send([]byte("restart @minicap service")) {
+				return
+			}
+			if err := minicap.RestartService(); err != nil && err != cmdctrl.ErrAlreadyRunning {
+				send([]byte("@minicap service start failed: " + err.Error()))
+			} else if !send([]byte("rotation " + strconv.Itoa(deviceRotation))) {
+				return
+			}
+			switch err := minicap.readSocket(dataC, quitC, rotationC); err {
+			case nil:
+				return
+			case errRotationChanged:
+				failures = 0
+			default:
+				log.Println("minicap stream:", err)
+				failures++
+			}
+			continue
+		}
+
+		minicap.StopService()
+		if !send([]byte("minicap is not available, fallback to screencap")) {
+			return
+		}
+		for failures >= 3 || !minicap.Available() {
+			data, err := screenshotJPEG(displayMaxWidthHeight, 80)
+			if err != nil {
+				send([]byte("screencap: " + err.Error()))
+				return
+			}
+			if !send(data) {
+				return
+			}
+			select {
+			case <-quitC:
+				return
+			case <-rotationC:
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// screenshotJPEG take a screenshot with screencap, used when minicap is not available
+func screenshotJPEG(maxSize int, quality int) ([]byte, error) {
+	output, err := runShellOutput("screencap", "-p")
+	if err != nil {
+		return nil, errors.Wrap(err, "screencap")
+	}
+	img, err := png.Decode(bytes.NewReader(output))
+	if err != nil {
+		return nil, errors.Wrap(err, "screencap")
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := encodeImage(buf, resizeImage(img, maxSize, maxSize), "jpeg", quality); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// subscribeRotation register a channel to rotationPublisher, call cancel when not used
+func subscribeRotation() (c chan interface{}, cancel func()) {
+	c = make(chan interface{}, 1)
+	rotationPublisher.Register(c)
+	return c, func() {
+		done := make(chan bool)
+		go func() { // broadcaster blocks on sending until unregistered
+			for {
+				select {
+				case <-c:
+				case <-done:
+					return
+				}
+			}
+		}()
+		rotationPublisher.Unregister(c)
+		close(done)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateMinicap(t *testing.T) {
+	server, client := net.Pipe()
+	frames := [][]byte{[]byte("\xff\xd8frame1"), []byte("\xff\xd8frame2"), []byte("not jpeg")}
+	go func() {
+		buf := bytes.NewBuffer(nil)
+		buf.Write([]byte{1, 24})
+		binary.Write(buf, binary.LittleEndian, []uint32{1234, 1080, 1920, 450, 800})
+		buf.Write([]byte{0, 2})
+		for _, frame := range frames {
+			binary.Write(buf, binary.LittleEndian, uint32(len(frame)))
+			buf.Write(frame)
+		}
+		server.Write(buf.Bytes())
+		server.Close()
+	}()
+
+	dataC := make(chan []byte, 10)
+	err := translateMinicap(client, dataC, make(chan bool))
+	assert.Equal(t, ErrJpegWrongFormat, err)
+	assert.Equal(t, 2, len(dataC))
+	assert.Equal(t, frames[0], <-dataC)
+	assert.Equal(t, frames[1], <-dataC)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openatx/atx-agent/cmdctrl"
+	"github.com/pkg/errors"
+)
+
+// minitouch prebuilt is located at
+//
+//	{assetsDir}/minitouch/{abi}/bin/minitouch
+//	{assetsDir}/minitouch/{abi}/bin/minitouch-nopie  (sdk < 16)
+const (
+	minitouchBinPath    = "/data/local/tmp/minitouch"
+	minitouchSocketName = "minitouch" // abstract unix socket: @minitouch
+)
+
+// MinitouchBanner is the first lines minitouch sends after connected
+// Ref: https://github.com/openstf/minitouch#usage
+type MinitouchBanner struct {
+	Version     int `json:"version"`
+	MaxContacts int `json:"maxContacts"`
+	MaxX        int `json:"maxX"`
+	MaxY        int `json:"maxY"`
+	MaxPressure int `json:"maxPressure"`
+	Pid         int `json:"pid"`
+}
+
+func readMinitouchBanner(rd *bufio.Reader) (banner MinitouchBanner, err error) {
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return banner, errors.Wrap(err, "read minitouch banner")
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "v":
+			_, err = fmt.Sscanf(line, "v %d", &banner.Version)
+		case "^":
+			_, err = fmt.Sscanf(line, "^ %d %d %d %d", &banner.MaxContacts, &banner.MaxX, &banner.MaxY, &banner.MaxPressure)
+		case "$":
+			_, err = fmt.Sscanf(line, "$ %d", &banner.Pid)
+			return banner, errors.Wrap(err, "minitouch banner")
+		}
+		if err != nil {
+			return banner, errors.Wrap(err, "minitouch banner")
+		}
+	}
+}
+
+// TouchRequest is the json message of websocket /minitouch.
+// Position is either percent (xP, yP) or pixel (x, y) of the screen as it is displayed now,
+// which is converted to the natural orientation according to deviceRotation.
+type TouchRequest struct {
+	Operation    string   `json:"operation"` // d, m, u, c, r, w
+	Index        int      `json:"index"`
+	PercentX     float64  `json:"xP"`
+	PercentY     float64  `json:"yP"`
+	X            *float64 `json:"x,omitempty"`
+	Y            *float64 `json:"y,omitempty"`
+	Pressure     float64  `json:"pressure"` // 0-100, default 50
+	Milliseconds int      `json:"milliseconds"`
+}
+
+// naturalPercent convert position to percent of display in natural orientation
+// display is the size in natural orientation, rotation is one of 0, 90, 180, 270
+func (req TouchRequest) naturalPercent(displayWidth, displayHeight int, rotation int) (float64, float64, error) {
+	xP, yP := req.PercentX, req.PercentY
+	if req.X != nil && req.Y != nil {
+		width, height := displayWidth, displayHeight
+		if rotation == 90 || rotation == 270 {
+			width, height = height, width
+		}
+		if width <= 0 || height <= 0 {
+			return 0, 0, errors.New("display size unknown, use xP and yP instead")
+		}
+		xP, yP = *req.X/float64(width), *req.Y/float64(height)
+	}
+	if xP < 0 || xP > 1 || yP < 0 || yP > 1 {
+		return 0, 0, fmt.Errorf("position (%v, %v) out of screen", xP, yP)
+	}
+	switch rotation {
+	case 90:
+		return 1 - yP, xP, nil
+	case 180:
+		return 1 - xP, 1 - yP, nil
+	case 270:
+		return yP, 1 - xP, nil
+	}
+	return xP, yP, nil
+}
+
+// MinitouchCommand convert request to minitouch command line
+func (req TouchRequest) MinitouchCommand(banner MinitouchBanner, displayWidth, displayHeight int, rotation int) (string, error) {
+	if req.Index < 0 || (banner.MaxContacts > 0 && req.Index >= banner.MaxContacts) {
+		return "", fmt.Errorf("index %d out of range, max contacts %d", req.Index, banner.MaxContacts)
+	}
+	switch req.Operation {
+	case "d", "m":
+		xP, yP, err := req.naturalPercent(displayWidth, displayHeight, rotation)
+		if err != nil {
+			return "", err
+		}
+		x := int(xP * float64(banner.MaxX))
+		y := int(yP * float64(banner.MaxY))
+		pressure := req.Pressure
+		if pressure <= 0 {
+			pressure = 50
+		}
+		if pressure > 100 {
+			pressure = 100
+		}
+		return fmt.Sprintf("%s %d %d %d %d\n", req.Operation, req.Index, x, y, int(pressure*float64(banner.MaxPressure)/100)), nil
+	case "u":
+		return fmt.Sprintf("u %d\n", req.Index), nil
+	case "c", "r":
+		return req.Operation + "\n", nil
+	case "w":
+		return fmt.Sprintf("w %d\n", req.Milliseconds), nil
+	}
+	return "", errors.New("unsupported operation: " + req.Operation)
+}
+
+type Minitouch struct {
+	mu      sync.Mutex
+	checked bool
+	err     error
+}
+
+var minitouch = &Minitouch{}
+
+// Install deploy minitouch from assetsDir
+func (m *Minitouch) Install() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checked = true
+	m.err = m.install()
+	if m.err != nil {
+		log.Println("minitouch unavailable:", m.err)
+	}
+	return m.err
+}
+
+func (m *Minitouch) install() error {
+	sdk, _ := strconv.Atoi(getCachedProperty("ro.build.version.sdk"))
+	binName := "minitouch"
+	if sdk < 16 {
+		binName = "minitouch-nopie"
+	}
+	for _, abi := range deviceABIs() {
+		bin := filepath.Join(assetsDir, "minitouch", strings.TrimSpace(abi), "bin", binName)
+		if fileExists(bin) {
+			return errors.Wrap(deployAsset(bin, minitouchBinPath), "deploy minitouch")
+		}
+	}
+	return fmt.Errorf("minitouch for abi %v not found in %s", deviceABIs(), assetsDir)
+}
+
+func (m *Minitouch) Available() bool {
+	m.mu.Lock()
+	checked := m.checked
+	m.mu.Unlock()
+	if !checked {
+		m.Install()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err == nil
+}
+
+// ServiceInfo for cmdctrl, minitouch listens on unix socket @minitouch
+func (m *Minitouch) ServiceInfo() cmdctrl.CommandInfo {
+	return cmdctrl.CommandInfo{
+		ArgsFunc: func() ([]string, error) {
+			if !m.Available() {
+				return nil, errors.New("minitouch is not available")
+			}
+			return []string{minitouchBinPath, "-n", minitouchSocketName}, nil
+		},
+	}
+}
+
+// Dial start minitouch service when needed and connect to it
+func (m *Minitouch) Dial() (conn net.Conn, rd *bufio.Reader, banner MinitouchBanner, err error) {
+	if err = service.Start("minitouch"); err != nil && err != cmdctrl.ErrAlreadyRunning {
+		return
+	}
+	for retries := 0; retries < 10; retries++ {
+		conn, err = net.Dial("unix", "@"+minitouchSocketName)
+		if err == nil {
+			break
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "dial @"+minitouchSocketName)
+		return
+	}
+	rd = bufio.NewReader(conn)
+	if banner, err = readMinitouchBanner(rd); err != nil {
+		conn.Close()
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMinitouchBanner(t *testing.T) {
+	rd := bufio.NewReader(strings.NewReader("v 1\n^ 10 1079 1919 2048\n$ 3456\nrest"))
+	banner, err := readMinitouchBanner(rd)
+	assert.Nil(t, err)
+	assert.Equal(t, MinitouchBanner{Version: 1, MaxContacts: 10, MaxX: 1079, MaxY: 1919, MaxPressure: 2048, Pid: 3456}, banner)
+
+	_, err = readMinitouchBanner(bufio.NewReader(strings.NewReader("v 1\n")))
+	assert.NotNil(t, err)
+}
+
+func TestTouchRequestMinitouchCommand(t *testing.T) {
+	banner := MinitouchBanner{MaxContacts: 2, MaxX: 1000, MaxY: 2000, MaxPressure: 200}
+	req := TouchRequest{Operation: "d", Index: 1, PercentX: 0.25, PercentY: 0.1}
+	line, err := req.MinitouchCommand(banner, 1080, 1920, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "d 1 250 200 100\n", line)
+
+	// landscape, top-left of screen is top-right in natural orientation
+	line, _ = req.MinitouchCommand(banner, 1080, 1920, 90)
+	assert.Equal(t, "d 1 900 500 100\n", line)
+	line, _ = req.MinitouchCommand(banner, 1080, 1920, 180)
+	assert.Equal(t, "d 1 750 1800 100\n", line)
+	line, _ = req.MinitouchCommand(banner, 1080, 1920, 270)
+	assert.Equal(t, "d 1 100 1500 100\n", line)
+
+	// pixel position of rotated screen: 1920x1080
+	x, y := 480.0, 108.0
+	req = TouchRequest{Operation: "m", X: &x, Y: &y, Pressure: 100}
+	line, _ = req.MinitouchCommand(banner, 1080, 1920, 90)
+	assert.Equal(t, "m 0 900 500 200\n", line)
+
+	line, _ = TouchRequest{Operation: "u", Index: 1}.MinitouchCommand(banner, 0, 0, 0)
+	assert.Equal(t, "u 1\n", line)
+	line, _ = TouchRequest{Operation: "c"}.MinitouchCommand(banner, 0, 0, 0)
+	assert.Equal(t, "c\n", line)
+
+	_, err = TouchRequest{Operation: "d", Index: 2}.MinitouchCommand(banner, 0, 0, 0)
+	assert.NotNil(t, err)
+	_, err = TouchRequest{Operation: "d", PercentX: 1.5}.MinitouchCommand(banner, 0, 0, 0)
+	assert.NotNil(t, err)
+	_, err = TouchRequest{Operation: "x"}.MinitouchCommand(banner, 0, 0, 0)
+	assert.NotNil(t, err)
+}
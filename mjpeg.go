@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/openatx/atx-agent/cmdctrl"
+)
+
+const (
+	mjpegBoundary       = "atxmjpegframe"
+	mjpegDefaultFPS     = 5
+	mjpegMaxFPS         = 30
+	mjpegDefaultQuality = 60
+	mjpegRetryMin       = 200 * time.Millisecond
+	mjpegRetryMax       = 5 * time.Second
+)
+
+// MJPEGOptions is parsed from query of /screenshot/mjpeg. Viewers with the same Minicap share a capture loop,
+// and viewers with the same options share the encoded frames.
+type MJPEGOptions struct {
+	FPS     int
+	Size    int // max width and height
+	Quality int
+	Minicap bool
+}
+
+func parseMJPEGOptions(form url.Values) (MJPEGOptions, error) {
+	opts := MJPEGOptions{
+		FPS:     mjpegDefaultFPS,
+		Size:    displayMaxWidthHeight,
+		Quality: mjpegDefaultQuality,
+		Minicap: form.Get("minicap") != "false",
+	}
+	for _, field := range []struct {
+		name     string
+		value    *int
+		min, max int
+	}{
+		{"fps", &opts.FPS, 1, mjpegMaxFPS},
+		{"size", &opts.Size, 1, 1 << 16},
+		{"quality", &opts.Quality, 1, 100},
+	} {
+		s := form.Get(field.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < field.min || n > field.max {
+			return opts, fmt.Errorf("invalid %s: %q, should be %d-%d", field.name, s, field.min, field.max)
+		}
+		*field.value = n
+	}
+	return opts, nil
+}
+
+// captureMJPEGRaw take a screenshot with the same methods as /screenshot/0, used when the minicap stream is not available
+func captureMJPEGRaw(useMinicap bool) ([]byte, error) {
+	data, _, err := screenshotCapturer.Take(useMinicap)
+	return data, err
+}
+
+// streamMinicapFrames send frames of the @minicap service to frames until quit closed (return nil).
+// The service is restarted when rotation changed, and stopped at last if it is started here.
+func streamMinicapFrames(frames chan []byte, quit chan bool) error {
+	if !minicap.Available() {
+		return errMinicapUnavailable
+	}
+	rotationC, cancel := subscribeRotation()
+	defer cancel()
+	err := service.Start("minicap")
+	if err != nil && err != cmdctrl.ErrAlreadyRunning {
+		return err
+	}
+	if err == nil {
+		defer minicap.StopService()
+	}
+	for {
+		err := minicap.readSocket(frames, quit, rotationC)
+		if err != errRotationChanged {
+			return err
+		}
+		if err := minicap.RestartService(); err != nil && err != cmdctrl.ErrAlreadyRunning {
+			return err
+		}
+	}
+}
+
+// encodeMJPEGFrame scale the screenshot and encode as jpeg
+func encodeMJPEGFrame(raw []byte, opts MJPEGOptions) ([]byte, error) {
+	displayWidth, displayHeight := naturalDisplaySize()
+	data, _, err := transformScreenshot(raw, ScreenshotOptions{
+		Format:     "jpeg",
+		Quality:    opts.Quality,
+		MaxWidth:   opts.Size,
+		MaxHeight:  opts.Size,
+		AutoRotate: true,
+	}, deviceRotation, displayWidth, displayHeight)
+	return data, err
+}
+
+// mjpegGroup is the viewers with the same options, a frame is encoded once for all of them
+type mjpegGroup struct {
+	viewers  map[chan []byte]bool
+	lastSent time.Time
+}
+
+// mjpegLoop capture screenshots of one source for all groups, at the highest fps of the groups
+type mjpegLoop struct {
+	groups map[MJPEGOptions]*mjpegGroup
+	fps    int
+	quit   chan bool
+}
+
+func (l *mjpegLoop) updateFPS() {
+	l.fps = 1
+	for opts := range l.groups {
+		if opts.FPS > l.fps {
+			l.fps = opts.FPS
+		}
+	}
+}
+
+// MJPEGHub run one capture loop for minicap and one for other methods, the loop stops when the last viewer left.
+// The minicap loop read frames from stream, and polls capture only when the stream failed.
+type MJPEGHub struct {
+	mu      sync.Mutex
+	loops   map[bool]*mjpegLoop // key is Minicap
+	capture func(useMinicap bool) ([]byte, error)
+	stream  func(frames chan []byte, quit chan bool) error // nil to always poll capture
+	encode  func(raw []byte, opts MJPEGOptions) ([]byte, error)
+}
+
+func NewMJPEGHub(capture func(useMinicap bool) ([]byte, error), encode func(raw []byte, opts MJPEGOptions) ([]byte, error)) *MJPEGHub {
+	return &MJPEGHub{
+		loops:   make(map[bool]*mjpegLoop),
+		capture: capture,
+		encode:  encode,
+	}
+}
+
+var mjpegHub = func() *MJPEGHub {
+	h := NewMJPEGHub(captureMJPEGRaw, encodeMJPEGFrame)
+	h.stream = streamMinicapFrames
+	return h
+}()
+
+// Subscribe return a channel of jpeg frames. Only the latest frame is kept for a slow viewer,
+// older frames not received are dropped.
+func (h *MJPEGHub) Subscribe(opts MJPEGOptions) (frames <-chan []byte, cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	loop, ok := h.loops[opts.Minicap]
+	if !ok {
+		loop = &mjpegLoop{
+			groups: make(map[MJPEGOptions]*mjpegGroup),
+			quit:   make(chan bool),
+		}
+		h.loops[opts.Minicap] = loop
+		go h.run(opts.Minicap, loop)
+	}
+	group, ok := loop.groups[opts]
+	if !ok {
+		group = &mjpegGroup{viewers: make(map[chan []byte]bool)}
+		loop.groups[opts] = group
+		loop.updateFPS()
+	}
+	c := make(chan []byte, 1)
+	group.viewers[c] = true
+	return c, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if !group.viewers[c] {
+			return
+		}
+		delete(group.viewers, c)
+		if len(group.viewers) > 0 {
+			return
+		}
+		delete(loop.groups, opts)
+		loop.updateFPS()
+		if len(loop.groups) == 0 {
+			delete(h.loops, opts.Minicap)
+			close(loop.quit)
+		}
+	}
+}
+
+func (h *MJPEGHub) run(useMinicap bool, loop *mjpegLoop) {
+	if useMinicap && h.stream != nil {
+		err := h.streamFrames(loop)
+		if err == nil {
+			return
+		}
+		// minicap -s would spawn a process for every frame, take screenshots with other methods instead
+		log.Println("mjpeg minicap stream:", err, ", fallback to screenshots")
+		useMinicap = false
+	}
+	h.poll(useMinicap, loop)
+}
+
+// streamFrames publish the frames of h.stream until the loop quit (return nil) or the stream failed
+func (h *MJPEGHub) streamFrames(loop *mjpegLoop) error {
+	frames := make(chan []byte)
+	errC := GoFunc(func() error {
+		return h.stream(frames, loop.quit)
+	})
+	for {
+		select {
+		case raw := <-frames:
+			h.publish(loop, raw, time.Now())
+		case err := <-errC:
+			return err
+		}
+	}
+}
+
+// poll capture screenshots at the fps of the loop, and back off while capture keeps failing
+func (h *MJPEGHub) poll(useMinicap bool, loop *mjpegLoop) {
+	var retry time.Duration
+	for {
+		start := time.Now()
+		raw, err := h.capture(useMinicap)
+		h.mu.Lock()
+		interval := time.Second / time.Duration(loop.fps)
+		h.mu.Unlock()
+		if err != nil {
+			retry *= 2
+			if retry < mjpegRetryMin {
+				retry = mjpegRetryMin
+			} else if retry > mjpegRetryMax {
+				retry = mjpegRetryMax
+			}
+			log.Printf("mjpeg capture: %v, retry in %v", err, retry)
+			interval = retry
+		} else {
+			retry = 0
+			h.publish(loop, raw, start)
+		}
+		select {
+		case <-loop.quit:
+			return
+		case <-time.After(time.Until(start.Add(interval))): // no wait when capture is slower than fps
+		}
+	}
+}
+
+// publish encode raw for the groups due at capturedAt, groups with lower fps than the loop skip some frames
+func (h *MJPEGHub) publish(loop *mjpegLoop, raw []byte, capturedAt time.Time) {
+	h.mu.Lock()
+	loopInterval := time.Second / time.Duration(loop.fps)
+	due := make(map[MJPEGOptions]*mjpegGroup)
+	for opts, group := range loop.groups {
+		// half of the loop interval is allowed for jitter
+		if capturedAt.Sub(group.lastSent) >= time.Second/time.Duration(opts.FPS)-loopInterval/2 {
+			group.lastSent = capturedAt
+			due[opts] = group
+		}
+	}
+	h.mu.Unlock()
+
+	for opts, group := range due {
+		frame, err := h.encode(raw, opts)
+		if err != nil {
+			log.Println("mjpeg encode:", err)
+			continue
+		}
+		h.send(group, frame)
+	}
+}
+
+func (h *MJPEGHub) send(group *mjpegGroup, frame []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range group.viewers {
+		select {
+		case c <- frame:
+		default:
+			// viewer is slow, replace the frame not received yet
+			select {
+			case <-c:
+			default:
+			}
+			c <- frame
+		}
+	}
+}
+
+// handleMJPEG stream the screen as multipart/x-mixed-replace, can be used as src of <img>
+//
+//	$ curl "$DEVICE_URL/screenshot/mjpeg?fps=10&size=480&quality=50"
+func handleMJPEG(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseMJPEGOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	frames, cancel := mjpegHub.Subscribe(opts)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case frame := <-frames:
+			_, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(frame))
+			if err == nil {
+				_, err = w.Write(frame) // frame is shared by viewers, never modify it
+			}
+			if err == nil {
+				_, err = io.WriteString(w, "\r\n")
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMJPEGOptions(t *testing.T) {
+	opts, err := parseMJPEGOptions(url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, MJPEGOptions{FPS: mjpegDefaultFPS, Size: displayMaxWidthHeight, Quality: mjpegDefaultQuality, Minicap: true}, opts)
+
+	opts, err = parseMJPEGOptions(url.Values{"fps": {"10"}, "size": {"480"}, "quality": {"50"}, "minicap": {"false"}})
+	assert.NoError(t, err)
+	assert.Equal(t, MJPEGOptions{FPS: 10, Size: 480, Quality: 50}, opts)
+
+	for _, query := range []url.Values{
+		{"fps": {"0"}},
+		{"fps": {"31"}},
+		{"size": {"abc"}},
+		{"quality": {"101"}},
+	} {
+		_, err := parseMJPEGOptions(query)
+		assert.Error(t, err, query.Encode())
+	}
+}
+
+// fakeCapture count captures of every source and encodes of every options,
+// raw frame is the count, and encoded frame is prefixed by size and quality
+type fakeCapture struct {
+	mu       sync.Mutex
+	captures map[bool]int
+	encodes  map[MJPEGOptions]int
+}
+
+func newFakeCapture() *fakeCapture {
+	return &fakeCapture{
+		captures: make(map[bool]int),
+		encodes:  make(map[MJPEGOptions]int),
+	}
+}
+
+func (f *fakeCapture) capture(useMinicap bool) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.captures[useMinicap]++
+	return []byte(strings.Repeat("x", f.captures[useMinicap])), nil
+}
+
+func (f *fakeCapture) encode(raw []byte, opts MJPEGOptions) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.encodes[opts]++
+	return []byte(fmt.Sprintf("%d:%d:%s", opts.Size, opts.Quality, raw)), nil
+}
+
+func (f *fakeCapture) count(useMinicap bool) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.captures[useMinicap]
+}
+
+func (f *fakeCapture) encodeCount(opts MJPEGOptions) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.encodes[opts]
+}
+
+func TestMJPEGHubShareLoop(t *testing.T) {
+	fake := newFakeCapture()
+	hub := NewMJPEGHub(fake.capture, fake.encode)
+	small := MJPEGOptions{FPS: 20, Size: 100, Quality: 50, Minicap: true}
+	large := MJPEGOptions{FPS: 20, Size: 800, Quality: 80, Minicap: true}
+
+	frames1, cancel1 := hub.Subscribe(small)
+	frames2, cancel2 := hub.Subscribe(small)
+	frames3, cancel3 := hub.Subscribe(large)
+	for i := 0; i < 5; i++ {
+		assert.True(t, strings.HasPrefix(string(<-frames1), "100:50:"))
+		<-frames2
+		assert.True(t, strings.HasPrefix(string(<-frames3), "800:80:"))
+	}
+	// all viewers are fed by the same loop, 20fps for about 250ms
+	assert.True(t, fake.count(true) < 10, "captured %d frames", fake.count(true))
+	assert.True(t, fake.encodeCount(small) <= fake.count(true), "encoded once for viewers of the same options")
+	assert.Equal(t, 0, fake.count(false))
+	hub.mu.Lock()
+	assert.Len(t, hub.loops, 1)
+	hub.mu.Unlock()
+
+	// another loop for the other source
+	frames4, cancel4 := hub.Subscribe(MJPEGOptions{FPS: 20, Size: 100, Quality: 50})
+	<-frames4
+	cancel4()
+	assert.True(t, fake.count(false) > 0)
+
+	cancel1()
+	cancel1() // twice is ok
+	<-frames2
+	cancel2()
+	cancel3()
+	hub.mu.Lock()
+	assert.Len(t, hub.loops, 0)
+	hub.mu.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	stopped := fake.count(true)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, stopped, fake.count(true), "capture loop should stop without viewers")
+}
+
+func TestMJPEGHubFPS(t *testing.T) {
+	fake := newFakeCapture()
+	hub := NewMJPEGHub(fake.capture, fake.encode)
+	fast := MJPEGOptions{FPS: 20, Size: 100, Quality: 50}
+	slow := MJPEGOptions{FPS: 5, Size: 100, Quality: 50}
+
+	_, cancelSlow := hub.Subscribe(slow)
+	_, cancelFast := hub.Subscribe(fast)
+	time.Sleep(500 * time.Millisecond)
+	// the loop runs at 20fps, and frames are skipped for the 5fps viewer
+	assert.True(t, fake.count(false) >= 6, "captured %d frames", fake.count(false))
+	assert.True(t, fake.encodeCount(slow) <= 4, "encoded %d frames for 5fps", fake.encodeCount(slow))
+	assert.True(t, fake.encodeCount(fast) > 2*fake.encodeCount(slow))
+
+	// back to 5fps when the fast viewer left
+	cancelFast()
+	time.Sleep(100 * time.Millisecond)
+	captured := fake.count(false)
+	time.Sleep(500 * time.Millisecond)
+	assert.True(t, fake.count(false)-captured <= 4, "captured %d frames in 500ms", fake.count(false)-captured)
+	cancelSlow()
+}
+
+func TestMJPEGHubSlowViewer(t *testing.T) {
+	fake := newFakeCapture()
+	hub := NewMJPEGHub(fake.capture, fake.encode)
+	opts := MJPEGOptions{FPS: 30, Size: 100, Quality: 50}
+	frames, cancel := hub.Subscribe(opts)
+	defer cancel()
+
+	time.Sleep(300 * time.Millisecond)
+	// frames not received are replaced by the latest one
+	frame := strings.TrimPrefix(string(<-frames), "100:50:")
+	assert.True(t, len(frame) > 1)
+	assert.True(t, len(frame) >= fake.count(false)-1)
+}
+
+func TestMJPEGHubStream(t *testing.T) {
+	fake := newFakeCapture()
+	hub := NewMJPEGHub(fake.capture, fake.encode)
+	streamErr := make(chan error)
+	hub.stream = func(frames chan []byte, quit chan bool) error {
+		for {
+			select {
+			case frames <- []byte("stream"):
+			case err := <-streamErr:
+				return err
+			case <-quit:
+				return nil
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	opts := MJPEGOptions{FPS: 20, Size: 100, Quality: 50, Minicap: true}
+	frames, cancel := hub.Subscribe(opts)
+	defer cancel()
+
+	// minicap frames are read from the stream
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "100:50:stream", string(<-frames))
+	}
+	assert.Equal(t, 0, fake.count(true))
+	assert.Equal(t, 0, fake.count(false))
+
+	// fallback to screenshots without minicap when the stream failed
+	streamErr <- errors.New("minicap crashed")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, fake.count(true))
+	assert.True(t, fake.count(false) > 0)
+	assert.True(t, strings.HasPrefix(string(<-frames), "100:50:x"))
+}
+
+func TestMJPEGHubCaptureBackoff(t *testing.T) {
+	var captures int32
+	hub := NewMJPEGHub(func(bool) ([]byte, error) {
+		atomic.AddInt32(&captures, 1)
+		return nil, errors.New("screen is secure")
+	}, newFakeCapture().encode)
+	_, cancel := hub.Subscribe(MJPEGOptions{FPS: 30, Size: 100, Quality: 50})
+	time.Sleep(700 * time.Millisecond)
+	cancel()
+	// retry after 200ms, 400ms, ... instead of 30 times per second
+	n := atomic.LoadInt32(&captures)
+	assert.True(t, n >= 2 && n <= 4, "captured %d times in 700ms", n)
+}
+
+func TestHandleMJPEG(t *testing.T) {
+	var captures int32
+	origin := mjpegHub
+	mjpegHub = NewMJPEGHub(func(bool) ([]byte, error) {
+		atomic.AddInt32(&captures, 1)
+		return []byte("raw"), nil
+	}, func([]byte, MJPEGOptions) ([]byte, error) {
+		return []byte("\xff\xd8jpeg\xff\xd9"), nil
+	})
+	defer func() { mjpegHub = origin }()
+
+	ts := httptest.NewServer(http.HandlerFunc(handleMJPEG))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?fps=abc")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "?fps=30")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "multipart/x-mixed-replace; boundary="+mjpegBoundary, resp.Header.Get("Content-Type"))
+	rd := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 5 {
+		line, err := rd.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{
+		"--" + mjpegBoundary + "\r\n",
+		"Content-Type: image/jpeg\r\n",
+		"Content-Length: 8\r\n",
+		"\r\n",
+		"\xff\xd8jpeg\xff\xd9\r\n",
+	}, lines)
+}
@@ -41,6 +41,7 @@ type DeviceInfo struct {
 	Memory                 *MemoryInfo           `json:"memory,omitempty"` // proc/meminfo
 	Cpu                    *CpuInfo              `json:"cpu,omitempty"`    // proc/cpuinfo
 	Arch                   string                `json:"arch"`
+	TLS                    *TLSInfo              `json:"tls,omitempty"`
 
 	Owner    *OwnerInfo `json:"owner" gorethink:"owner,omitempty"`
 	Reserved string     `json:"reserved,omitempty"`
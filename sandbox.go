@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	fsRoots   []string     // set by: server --fs-root
+	fsSandbox = &Sandbox{} // no roots means every path is allowed
+)
+
+// Reasons of SandboxError
+const (
+	sandboxOutsideRoots  = "outside-allowed-roots"
+	sandboxPathTraversal = "path-traversal"
+	sandboxZipSlip       = "zip-slip"
+	sandboxInvalidPath   = "invalid-path"
+)
+
+// SandboxError is returned when a path is not allowed to access
+type SandboxError struct {
+	Path   string
+	Reason string
+}
+
+func (e *SandboxError) Error() string {
+	return fmt.Sprintf("access %s denied: %s", e.Path, e.Reason)
+}
+
+// Sandbox limit file access to the allowed roots, symlinks are resolved before checking,
+// so that a link inside the roots can not be used to access files outside.
+type Sandbox struct {
+	roots []string // resolved absolute paths
+}
+
+func NewSandbox(roots []string) (*Sandbox, error) {
+	s := &Sandbox{}
+	for _, root := range roots {
+		if !filepath.IsAbs(root) {
+			return nil, fmt.Errorf("fs root must be absolute path: %s", root)
+		}
+		real, err := resolveSymlinks(filepath.Clean(root))
+		if err != nil {
+			return nil, err
+		}
+		s.roots = append(s.roots, real)
+	}
+	return s, nil
+}
+
+func (s *Sandbox) Roots() []string {
+	return append([]string{}, s.roots...)
+}
+
+// pathWithin return true when p is dir or inside dir, both should be cleaned
+func pathWithin(p, dir string) bool {
+	if p == dir || dir == string(filepath.Separator) {
+		return true
+	}
+	return strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+func hasDotDot(p string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(p), "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSymlinks is like filepath.EvalSymlinks, but the path need not exist.
+// The longest existing part is resolved and the rest is kept, dangling symlinks are followed too.
+func resolveSymlinks(p string) (string, error) {
+	return resolveSymlinksDepth(p, 0)
+}
+
+func resolveSymlinksDepth(p string, depth int) (string, error) {
+	if depth > 40 {
+		return "", &SandboxError{Path: p, Reason: "too many levels of symbolic links"}
+	}
+	rest := ""
+	cur := p
+	for {
+		real, err := filepath.EvalSymlinks(cur)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if finfo, lerr := os.Lstat(cur); lerr == nil && finfo.Mode()&os.ModeSymlink != 0 {
+			// dangling symlink, writing to it creates the file where it points to
+			target, err := os.Readlink(cur)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(cur), target)
+			}
+			return resolveSymlinksDepth(filepath.Join(target, rest), depth+1)
+		}
+		parent := filepath.Dir(cur)
+		if parent == cur {
+			return p, nil
+		}
+		rest = filepath.Join(filepath.Base(cur), rest)
+		cur = parent
+	}
+}
+
+// Resolve return the real path of p, error when p contains .. or is outside the roots
+func (s *Sandbox) Resolve(p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		return "", &SandboxError{Path: p, Reason: sandboxInvalidPath}
+	}
+	if hasDotDot(p) {
+		return "", &SandboxError{Path: p, Reason: sandboxPathTraversal}
+	}
+	real, err := resolveSymlinks(filepath.Clean(p))
+	if err != nil {
+		return "", err
+	}
+	if len(s.roots) == 0 {
+		return real, nil
+	}
+	for _, root := range s.roots {
+		if pathWithin(real, root) {
+			return real, nil
+		}
+	}
+	return "", &SandboxError{Path: p, Reason: sandboxOutsideRoots}
+}
+
+// ResolveEntry is like Resolve, but the last element of p is not followed when it is a symlink,
+// so that the link itself can be removed or renamed. The roots and / can not be resolved.
+func (s *Sandbox) ResolveEntry(p string) (string, error) {
+	if !filepath.IsAbs(p) || filepath.Clean(p) == string(filepath.Separator) {
+		return "", &SandboxError{Path: p, Reason: sandboxInvalidPath}
+	}
+	if hasDotDot(p) {
+		return "", &SandboxError{Path: p, Reason: sandboxPathTraversal}
+	}
+	p = filepath.Clean(p)
+	parent, err := s.Resolve(filepath.Dir(p))
+	if err != nil {
+		if serr, ok := err.(*SandboxError); ok {
+			serr.Path = p
+		}
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(p)), nil
+}
+
+// renderPathError render SandboxError as 403, other errors with the status given
+func renderPathError(w http.ResponseWriter, err error, status int) {
+	serr, ok := err.(*SandboxError)
+	if !ok {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	js, _ := json.Marshal(map[string]interface{}{
+		"success":      false,
+		"description":  serr.Error(),
+		"path":         serr.Path,
+		"reason":       serr.Reason,
+		"allowedRoots": fsSandbox.Roots(),
+	})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(js)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSandboxResolve(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "sandbox")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	tmpdir, _ = filepath.EvalSymlinks(tmpdir)
+
+	root := filepath.Join(tmpdir, "root")
+	outside := filepath.Join(tmpdir, "outside")
+	os.MkdirAll(root, 0755)
+	os.MkdirAll(outside, 0755)
+	ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	os.Symlink(filepath.Join(outside, "missing.txt"), filepath.Join(root, "dangling"))
+
+	sandbox, err := NewSandbox([]string{root})
+	assert.Nil(t, err)
+
+	real, err := sandbox.Resolve(filepath.Join(root, "a.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "a.txt"), real)
+
+	_, err = sandbox.Resolve(filepath.Join(root, "new/dir/b.txt"))
+	assert.Nil(t, err)
+
+	reason := func(err error) string {
+		if serr, ok := err.(*SandboxError); ok {
+			return serr.Reason
+		}
+		return ""
+	}
+	_, err = sandbox.Resolve(root + "/../outside/x")
+	assert.Equal(t, sandboxPathTraversal, reason(err))
+	_, err = sandbox.Resolve(filepath.Join(outside, "x"))
+	assert.Equal(t, sandboxOutsideRoots, reason(err))
+	_, err = sandbox.Resolve(filepath.Join(root, "escape", "x"))
+	assert.Equal(t, sandboxOutsideRoots, reason(err))
+	_, err = sandbox.Resolve(filepath.Join(root, "dangling"))
+	assert.Equal(t, sandboxOutsideRoots, reason(err))
+	_, err = sandbox.Resolve("relative/path")
+	assert.Equal(t, sandboxInvalidPath, reason(err))
+
+	unrestricted, _ := NewSandbox(nil)
+	_, err = unrestricted.Resolve(filepath.Join(outside, "x"))
+	assert.Nil(t, err)
+}
+
+func TestExtractZipSlip(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "extract")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	makeZip := func(names ...string) *bytes.Reader {
+		buf := bytes.NewBuffer(nil)
+		zw := zip.NewWriter(buf)
+		for _, name := range names {
+			w, _ := zw.Create(name)
+			w.Write([]byte(name))
+		}
+		zw.Close()
+		return bytes.NewReader(buf.Bytes())
+	}
+
+	dest := filepath.Join(tmpdir, "dest")
+	rd := makeZip("a.txt", "sub/b.txt")
+	files, err := extractZip(rd, rd.Size(), dest)
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+	data, _ := ioutil.ReadFile(filepath.Join(dest, "sub/b.txt"))
+	assert.Equal(t, "sub/b.txt", string(data))
+
+	rd = makeZip("../evil.txt")
+	_, err = extractZip(rd, rd.Size(), dest)
+	assert.IsType(t, &SandboxError{}, err)
+	assert.False(t, fileExists(filepath.Join(tmpdir, "evil.txt")))
+
+	os.Symlink(tmpdir, filepath.Join(dest, "link"))
+	_, err = safeJoin(dest, "link/evil.txt")
+	assert.IsType(t, &SandboxError{}, err)
+	_, err = safeJoin(dest, "/etc/passwd")
+	assert.IsType(t, &SandboxError{}, err)
+}
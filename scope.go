@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Scopes granted to tokens
+//   - read: device info, screenshot, process list and other read only api
+//   - files: read and write files
+//   - shell: run commands, install apps and control the device (uiautomator, minitouch)
+//   - admin: everything, including stop, upgrade and manage services
+//
+// read is included in every other scope.
+const (
+	ScopeRead  = "read"
+	ScopeFiles = "files"
+	ScopeShell = "shell"
+	ScopeAdmin = "admin"
+)
+
+type scopesContextKeyType struct{}
+
+var scopesContextKey = scopesContextKeyType{}
+
+type ScopeSet map[string]bool
+
+func parseScopes(s string) (ScopeSet, error) {
+	scopes := make(ScopeSet)
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		switch scope {
+		case "":
+			continue
+		case ScopeRead, ScopeFiles, ScopeShell, ScopeAdmin:
+			scopes[scope] = true
+		default:
+			return nil, fmt.Errorf("unknown scope: %q", scope)
+		}
+	}
+	return scopes, nil
+}
+
+func (scopes ScopeSet) Has(scope string) bool {
+	if scopes[ScopeAdmin] {
+		return true
+	}
+	if scope == ScopeRead {
+		return len(scopes) > 0
+	}
+	return scopes[scope]
+}
+
+// routeScopes map "METHOD path-template" or "path-template" to the required scope,
+// path template is the same as the one registered in initHTTPServer.
+// Routes not listed here require admin.
+var routeScopes = map[string]string{
+	"/":                           ScopeRead,
+	"/version":                    ScopeRead,
+	"/ping":                       ScopeRead,
+	"/info":                       ScopeRead,
+	"GET /info/rotation":          ScopeRead,
+	"/wlan/ip":                    ScopeRead,
+	"/dump/hierarchy":             ScopeRead,
+	"/proc/list":                  ScopeRead,
+	"/proc/{pkgname}/meminfo":     ScopeRead,
+	"/proc/{pkgname}/meminfo/all": ScopeRead,
+	"/proc/{pkgname}/cpuinfo":     ScopeRead,
+	"/webviews":                   ScopeRead,
+	"/webviews/{pkgname}":         ScopeRead,
+	"/pidof/{pkgname}":            ScopeRead,
+	"/packages":                   ScopeRead,
+	"/packages/{pkgname}/info":    ScopeRead,
+	"/packages/{pkgname}/icon":    ScopeRead,
+	"/screenshot":                 ScopeRead,
+	"/screenshot/0":               ScopeRead,
+	"GET /screenshot/mjpeg":       ScopeRead,
+	"GET /screenshot/metrics":     ScopeRead,
+	"GET /minicap":                ScopeRead,
+	"GET /screenrecord":           ScopeRead,
+	"/screenrecord/playlist.m3u":  ScopeRead,
+	"/screenrecord/bundle.zip":    ScopeRead,
+	"/screenrecord/videos/{name}": ScopeRead,
+	"GET /install":                ScopeRead,
+	"GET /install/{id}":           ScopeRead,
+	"GET /download":               ScopeRead,
+	"GET /download/{id}":          ScopeRead,
+	"GET /logcat":                 ScopeRead,
+	"GET /logcat/marks":           ScopeRead,
+	"POST /logcat/marks":          ScopeRead,
+	"GET /services/{name}":        ScopeRead,
+
+	"/raw/{filepath:.*}":    ScopeFiles,
+	"/finfo/{lpath:.*}":     ScopeFiles,
+	"/upload/{target:.*}":   ScopeFiles,
+	"/files/{lpath:.*}":     ScopeFiles,
+	"/sync/{lpath:.*}":      ScopeFiles,
+	"/checksum/{lpath:.*}":  ScopeFiles,
+	"/uploads":              ScopeFiles,
+	"/uploads/{id}":         ScopeFiles,
+	"/uploads/{id}/finish":  ScopeFiles,
+	"POST /download":        ScopeFiles,
+	"DELETE /download/{id}": ScopeFiles,
+
+	"/info/battery":                 ScopeShell, // posted by the apk on device without token, see loopbackAuthAllowPaths
+	"/info/rotation":                ScopeShell,
+	"/shell":                        ScopeShell,
+	"/term":                         ScopeShell,
+	"/shell/background":             ScopeShell,
+	"/shell/background/{id}":        ScopeShell,
+	"/shell/background/{id}/output": ScopeShell,
+	"/shell/background/{id}/signal": ScopeShell,
+	"/shell/background/{id}/wait":   ScopeShell,
+	"/session/{pkgname}":            ScopeShell,
+	"/jsonrpc/0":                    ScopeShell,
+	"/newCommandTimeout":            ScopeShell,
+	"GET /minitouch":                ScopeShell,
+	"POST /install":                 ScopeShell,
+	"DELETE /install/{id}":          ScopeShell,
+	"POST /screenrecord":            ScopeShell,
+	"PUT /screenrecord":             ScopeShell,
+
+	"/session/{pid:[0-9]+}:{pkgname}/{url:ping|jsonrpc/0}": ScopeShell,
+
+	"/stop":                   ScopeAdmin,
+	"/upgrade":                ScopeAdmin,
+	"POST /services/{name}":   ScopeAdmin,
+	"DELETE /services/{name}": ScopeAdmin,
+	"PUT /minicap":            ScopeAdmin,
+	"PUT /minitouch":          ScopeAdmin,
+}
+
+func requiredScope(method, pathTemplate string) string {
+	if scope, ok := routeScopes[method+" "+pathTemplate]; ok {
+		return scope
+	}
+	if scope, ok := routeScopes[pathTemplate]; ok {
+		return scope
+	}
+	return ScopeAdmin
+}
+
+func scopesFromContext(r *http.Request) (ScopeSet, bool) {
+	scopes, ok := r.Context().Value(scopesContextKey).(ScopeSet)
+	return scopes, ok
+}
+
+// checkScope is a mux middleware, which reject request when token lacks the scope of route.
+// Request without scopes in context is passed, authentication is disabled or path is allowed.
+func checkScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scopes, ok := scopesFromContext(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ = route.GetPathTemplate()
+		}
+		scope := requiredScope(r.Method, template)
+		if scopes.Has(scope) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Printf("forbidden request %s %s from %s, missing scope %s", r.Method, r.URL.Path, r.RemoteAddr, scope)
+		js, _ := json.Marshal(map[string]interface{}{
+			"success":      false,
+			"description":  fmt.Sprintf("permission denied, scope %q is required", scope),
+			"missingScope": scope,
+		})
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(js)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := parseScopes("read, files")
+	assert.Nil(t, err)
+	assert.True(t, scopes.Has(ScopeRead))
+	assert.True(t, scopes.Has(ScopeFiles))
+	assert.False(t, scopes.Has(ScopeShell))
+
+	scopes, _ = parseScopes("shell")
+	assert.True(t, scopes.Has(ScopeRead))
+	scopes, _ = parseScopes("admin")
+	assert.True(t, scopes.Has(ScopeShell))
+
+	_, err = parseScopes("root")
+	assert.NotNil(t, err)
+}
+
+func TestCheckScope(t *testing.T) {
+	auth, err := NewAuthenticator([]string{"viewer:read", "runner:files,shell", "root"}, "", nil)
+	assert.Nil(t, err)
+
+	m := mux.NewRouter()
+	m.Use(checkScope)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	m.HandleFunc("/info", ok)
+	m.HandleFunc("/shell", ok)
+	m.HandleFunc("/upload/{target:.*}", ok)
+	m.HandleFunc("/services/{name}", ok).Methods("GET", "POST", "DELETE")
+	m.HandleFunc("/not-listed", ok)
+	handler := auth.Wrap(m)
+
+	request := func(method, url, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, 200, request("GET", "/info", "viewer").Code)
+	assert.Equal(t, 200, request("GET", "/services/minicap", "viewer").Code)
+	rec := request("POST", "/shell", "viewer")
+	assert.Equal(t, 403, rec.Code)
+	var resp map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "shell", resp["missingScope"])
+	assert.Equal(t, false, resp["success"])
+
+	assert.Equal(t, 200, request("POST", "/shell", "runner").Code)
+	assert.Equal(t, 200, request("POST", "/upload/sdcard/", "runner").Code)
+	assert.Equal(t, 403, request("DELETE", "/services/minicap", "runner").Code)
+	assert.Equal(t, 403, request("GET", "/not-listed", "runner").Code)
+	assert.Equal(t, 200, request("DELETE", "/services/minicap", "root").Code)
+	assert.Equal(t, 200, request("GET", "/not-listed", "root").Code)
+}
+
+func TestRouteScopesCoverAllRoutes(t *testing.T) {
+	server := NewServer()
+	templates := make(map[string]bool)
+	server.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		if len(methods) == 0 {
+			methods = []string{""}
+		}
+		for _, method := range methods {
+			_, ok1 := routeScopes[template]
+			_, ok2 := routeScopes[method+" "+template]
+			assert.True(t, ok1 || ok2, "route %s %s has no scope", method, template)
+		}
+		templates[template] = true
+		return nil
+	})
+	for key := range routeScopes {
+		fields := strings.Fields(key) // [METHOD] template
+		assert.True(t, templates[fields[len(fields)-1]], "scope of %s is not used", key)
+	}
+}
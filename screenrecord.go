@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openatx/atx-agent/cmdctrl"
+	"github.com/pkg/errors"
+)
+
+const (
+	screenrecordDir = "/sdcard/screenrecords"
+
+	// android screenrecord stops after 180s, so roll over to next segment a little earlier
+	screenrecordMaxSegment     = 180
+	screenrecordDefaultSegment = 170
+)
+
+var screenrecordSizePattern = regexp.MustCompile(`^\d+x\d+$`)
+
+type ScreenRecordOptions struct {
+	BitRate        int    `json:"bitRate,omitempty"` // bits per second, 0 means default of screenrecord
+	Size           string `json:"size,omitempty"`    // WIDTHxHEIGHT
+	Rotate         bool   `json:"rotate"`
+	SegmentSeconds int    `json:"segmentSeconds"`
+}
+
+// parseBitRate accept 4000000, 4M, 800K
+func parseBitRate(s string) (int, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	unit := 1
+	switch {
+	case strings.HasSuffix(s, "M"):
+		unit = 1000000
+	case strings.HasSuffix(s, "K"):
+		unit = 1000
+	}
+	s = strings.TrimRight(s, "MK")
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("invalid bit rate: %s", s)
+	}
+	return int(v * float64(unit)), nil
+}
+
+func (opts ScreenRecordOptions) Validate() error {
+	if opts.Size != "" && !screenrecordSizePattern.MatchString(opts.Size) {
+		return errors.New("size should be like 1280x720")
+	}
+	if opts.SegmentSeconds <= 0 || opts.SegmentSeconds > screenrecordMaxSegment {
+		return fmt.Errorf("segment seconds should be in range 1-%d", screenrecordMaxSegment)
+	}
+	return nil
+}
+
+func (opts ScreenRecordOptions) Args(filename string) []string {
+	args := []string{"screenrecord", "--time-limit", strconv.Itoa(opts.SegmentSeconds)}
+	if opts.BitRate > 0 {
+		args = append(args, "--bit-rate", strconv.Itoa(opts.BitRate))
+	}
+	if opts.Size != "" {
+		args = append(args, "--size", opts.Size)
+	}
+	if opts.Rotate {
+		args = append(args, "--rotate")
+	}
+	return append(args, filename)
+}
+
+type ScreenRecordSegment struct {
+	Path      string        `json:"path"`
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  time.Duration `json:"-"`
+}
+
+// ScreenRecorder run screenrecord as service "screenrecord", a new segment is
+// started every time screenrecord quit because of time limit.
+type ScreenRecorder struct {
+	mu        sync.Mutex
+	dir       string
+	options   ScreenRecordOptions
+	segments  []*ScreenRecordSegment
+	recording bool
+	startedAt time.Time
+	stoppedAt time.Time
+}
+
+func NewScreenRecorder(dir string) *ScreenRecorder {
+	return &ScreenRecorder{dir: dir}
+}
+
+var screenRecorder = NewScreenRecorder(screenrecordDir)
+
+// finishSegment must be called with lock held
+func (s *ScreenRecorder) finishSegment(now time.Time) {
+	if n := len(s.segments); n > 0 && s.segments[n-1].Duration == 0 {
+		s.segments[n-1].Duration = now.Sub(s.segments[n-1].StartedAt)
+	}
+}
+
+func (s *ScreenRecorder) nextSegmentArgs() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.finishSegment(now)
+	segment := &ScreenRecordSegment{
+		Path:      filepath.Join(s.dir, fmt.Sprintf("%d.mp4", len(s.segments))),
+		StartedAt: now,
+	}
+	s.segments = append(s.segments, segment)
+	return s.options.Args(segment.Path), nil
+}
+
+func (s *ScreenRecorder) ServiceInfo() cmdctrl.CommandInfo {
+	return cmdctrl.CommandInfo{
+		ArgsFunc:        s.nextSegmentArgs,
+		MaxRetries:      3,               // screenrecord failed to start
+		RecoverDuration: 5 * time.Second, // segment finished normally, continue recording
+		NextLaunchWait:  100 * time.Millisecond,
+		StopSignal:      os.Interrupt, // screenrecord finish the mp4 on SIGINT
+		OnStop: func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.recording = false
+			s.stoppedAt = time.Now()
+			s.finishSegment(s.stoppedAt)
+		},
+	}
+}
+
+// Start remove the old recording and start a new one
+func (s *ScreenRecorder) Start(opts ScreenRecordOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if service.Running("screenrecord") {
+		return cmdctrl.ErrAlreadyRunning
+	}
+	os.RemoveAll(s.dir)
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.options = opts
+	s.segments = nil
+	s.recording = true
+	s.startedAt = time.Now()
+	s.stoppedAt = time.Time{}
+	s.mu.Unlock()
+	if err := service.Start("screenrecord"); err != nil {
+		s.mu.Lock()
+		s.recording = false
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Stop recording and return the recorded videos
+func (s *ScreenRecorder) Stop() ([]string, error) {
+	err := service.Stop("screenrecord", true)
+	return s.Videos(), err
+}
+
+// Segments return segments which video file exists
+func (s *ScreenRecorder) Segments() []ScreenRecordSegment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	segments := make([]ScreenRecordSegment, 0, len(s.segments))
+	for _, seg := range s.segments {
+		if finfo, err := os.Stat(seg.Path); err == nil && finfo.Size() > 0 {
+			segments = append(segments, *seg)
+		}
+	}
+	return segments
+}
+
+func (s *ScreenRecorder) Videos() []string {
+	videos := make([]string, 0)
+	for _, seg := range s.Segments() {
+		videos = append(videos, seg.Path)
+	}
+	return videos
+}
+
+func (s *ScreenRecorder) Status() map[string]interface{} {
+	s.mu.Lock()
+	recording, options, startedAt, stoppedAt := s.recording, s.options, s.startedAt, s.stoppedAt
+	s.mu.Unlock()
+	status := map[string]interface{}{
+		"recording": recording,
+		"options":   options,
+		"videos":    s.Videos(),
+	}
+	if !startedAt.IsZero() {
+		status["startedAt"] = startedAt
+		end := stoppedAt
+		if recording {
+			end = time.Now()
+		}
+		status["duration"] = end.Sub(startedAt).Seconds()
+	}
+	return status
+}
+
+// WritePlaylist write an extended m3u playlist, urlPrefix is prepended to video file name
+func (s *ScreenRecorder) WritePlaylist(w io.Writer, urlPrefix string) error {
+	if _, err := io.WriteString(w, "#EXTM3U\n"); err != nil {
+		return err
+	}
+	for _, seg := range s.Segments() {
+		duration := seg.Duration
+		if duration == 0 { // still recording
+			duration = time.Since(seg.StartedAt)
+		}
+		_, err := fmt.Fprintf(w, "#EXTINF:%d,%s\n%s%s\n", int(duration.Seconds()+0.5),
+			seg.StartedAt.Format(time.RFC3339), urlPrefix, filepath.Base(seg.Path))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteZip write all videos into a zip, mp4 is already compressed, so just store
+func (s *ScreenRecorder) WriteZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, seg := range s.Segments() {
+		header := &zip.FileHeader{Name: filepath.Base(seg.Path), Method: zip.Store, Modified: seg.StartedAt}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(seg.Path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
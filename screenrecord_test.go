@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBitRate(t *testing.T) {
+	for input, expect := range map[string]int{"4000000": 4000000, "4M": 4000000, "1.5m": 1500000, "800K": 800000} {
+		v, err := parseBitRate(input)
+		assert.Nil(t, err)
+		assert.Equal(t, expect, v, input)
+	}
+	_, err := parseBitRate("fast")
+	assert.NotNil(t, err)
+}
+
+func TestScreenRecordOptions(t *testing.T) {
+	opts := ScreenRecordOptions{BitRate: 4000000, Size: "1280x720", Rotate: true, SegmentSeconds: 170}
+	assert.Nil(t, opts.Validate())
+	assert.Equal(t, []string{"screenrecord", "--time-limit", "170", "--bit-rate", "4000000",
+		"--size", "1280x720", "--rotate", "/sdcard/0.mp4"}, opts.Args("/sdcard/0.mp4"))
+
+	assert.NotNil(t, ScreenRecordOptions{Size: "big", SegmentSeconds: 170}.Validate())
+	assert.NotNil(t, ScreenRecordOptions{SegmentSeconds: 181}.Validate())
+}
+
+func TestScreenRecorderSegments(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "screenrecord")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	s := NewScreenRecorder(tmpdir)
+	s.options = ScreenRecordOptions{SegmentSeconds: 170}
+	for i := 0; i < 3; i++ {
+		args, err := s.nextSegmentArgs()
+		assert.Nil(t, err)
+		if i < 2 { // the last one failed to record
+			ioutil.WriteFile(args[len(args)-1], []byte("video"), 0644)
+		}
+	}
+	s.segments[0].StartedAt = s.segments[0].StartedAt.Add(-170 * time.Second)
+	s.segments[0].Duration = 170 * time.Second
+	assert.Equal(t, []string{filepath.Join(tmpdir, "0.mp4"), filepath.Join(tmpdir, "1.mp4")}, s.Videos())
+
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, s.WritePlaylist(buf, "videos/"))
+	assert.Contains(t, buf.String(), "#EXTM3U\n#EXTINF:170,")
+	assert.Contains(t, buf.String(), "\nvideos/0.mp4\n")
+	assert.Contains(t, buf.String(), "\nvideos/1.mp4\n")
+
+	buf.Reset()
+	assert.Nil(t, s.WriteZip(buf))
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(zr.File))
+	assert.Equal(t, "1.mp4", zr.File[1].Name)
+}
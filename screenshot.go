@@ -1,15 +1,241 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
 	"github.com/pkg/errors"
 )
 
-func screenshotWithScreencap(filename string) (err error) {
-	_, err = runShellOutput("screencap", "-p", filename)
-	err = errors.Wrap(err, "screencap")
-	return
+var errCropOutside = errors.New("crop rectangle is outside of the screenshot")
+
+func screenshotWithScreencap() ([]byte, error) {
+	data, err := runShellOutput("screencap", "-p")
+	return data, errors.Wrap(err, "screencap")
+}
+
+// screenshotWithUiautomator return the screenshot of uiautomator server (jpeg)
+func screenshotWithUiautomator() ([]byte, error) {
+	resp, err := http.Get("http://127.0.0.1:9008/screenshot/0")
+	if err != nil {
+		return nil, errors.Wrap(err, "uiautomator")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("uiautomator: screenshot status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, errors.Wrap(err, "uiautomator")
 }
 
 func isMinicapSupported() bool {
-	return false
+	return minicap.Available()
+}
+
+// takeScreenshot return the screenshot and the method used.
+//   - android emulator use screencap
+//   - then minicap when binary and .so exists
+//   - then uiautomator when service(uiautomator) is running
+//   - last screencap
+func takeScreenshot(useMinicap bool) (data []byte, method string, err error) {
+	method = "screencap"
+	if getCachedProperty("ro.product.cpu.abi") == "x86" { // android emulator
+		method = "screencap"
+	} else if useMinicap && isMinicapSupported() {
+		method = "minicap"
+	} else if service.Running("uiautomator") {
+		method = "uiautomator"
+	}
+
+	switch method {
+	case "screencap":
+		data, err = screenshotWithScreencap()
+	case "minicap":
+		data, err = minicap.Screenshot()
+		if err != nil && service.Running("uiautomator") {
+			log.Println("minicap screenshot failed:", err)
+			method = "uiautomator"
+			data, err = screenshotWithUiautomator()
+		}
+	case "uiautomator":
+		data, err = screenshotWithUiautomator()
+	}
+	if err != nil && method != "screencap" {
+		method = "screencap"
+		data, err = screenshotWithScreencap()
+	}
+	return data, method, err
+}
+
+// naturalDisplaySize return the display size in natural orientation, zero when unknown
+func naturalDisplaySize() (width, height int) {
+	if display := getDeviceInfo().Display; display != nil {
+		return display.Width, display.Height
+	}
+	return 0, 0
+}
+
+// ScreenshotOptions is parsed from query of /screenshot/0, zero value means the original image
+//   - format: png, jpeg or webp, default is the format of the original image
+//   - quality: jpeg quality 1-100
+//   - size, maxWidth, maxHeight: image is scaled down to fit, aspect ratio kept
+//   - crop: x,y,width,height of the (rotated) screenshot, before scaling
+//   - rotate: auto (according to the rotation of the display), 0, 90, 180 or 270
+type ScreenshotOptions struct {
+	Format     string
+	Quality    int
+	MaxWidth   int
+	MaxHeight  int
+	Crop       image.Rectangle
+	Rotate     int
+	AutoRotate bool
+}
+
+func parseScreenshotOptions(form url.Values) (opts ScreenshotOptions, err error) {
+	positive := func(name string) (int, error) {
+		s := form.Get(name)
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid %s: %q, should be a positive integer", name, s)
+		}
+		return n, nil
+	}
+	if format := strings.ToLower(form.Get("format")); format != "" {
+		if imageContentType(format) == "" {
+			return opts, fmt.Errorf("unsupported format: %q, should be png, jpeg or webp", format)
+		}
+		opts.Format = format
+	}
+	if opts.Quality, err = positive("quality"); err != nil {
+		return
+	}
+	if opts.Quality > 100 {
+		return opts, fmt.Errorf("invalid quality: %d, should be 1-100", opts.Quality)
+	}
+	size, err := positive("size")
+	if err != nil {
+		return
+	}
+	opts.MaxWidth, opts.MaxHeight = size, size
+	if n, err := positive("maxWidth"); err != nil {
+		return opts, err
+	} else if n > 0 {
+		opts.MaxWidth = n
+	}
+	if n, err := positive("maxHeight"); err != nil {
+		return opts, err
+	} else if n > 0 {
+		opts.MaxHeight = n
+	}
+	if s := form.Get("crop"); s != "" {
+		var x, y, w, h int
+		if n, _ := fmt.Sscanf(s, "%d,%d,%d,%d", &x, &y, &w, &h); n != 4 || x < 0 || y < 0 || w <= 0 || h <= 0 {
+			return opts, fmt.Errorf("invalid crop: %q, should be x,y,width,height", s)
+		}
+		opts.Crop = image.Rect(x, y, x+w, y+h)
+	}
+	switch s := form.Get("rotate"); s {
+	case "":
+	case "auto":
+		opts.AutoRotate = true
+	case "0", "90", "180", "270":
+		opts.Rotate, _ = strconv.Atoi(s)
+	default:
+		return opts, fmt.Errorf("invalid rotate: %q, should be auto, 0, 90, 180 or 270", s)
+	}
+	return opts, nil
+}
+
+// IsZero is true when the screenshot is served as it is
+func (o ScreenshotOptions) IsZero() bool {
+	return o == ScreenshotOptions{}
+}
+
+// autoRotation return how much the image need to be rotated. Screenshot of minicap and screencap
+// usually follows the display, so the image is rotated only when it is still in the natural orientation.
+// Upside down (180) can not be detected by the size, and is not rotated.
+func autoRotation(imgWidth, imgHeight, displayWidth, displayHeight, rotation int) int {
+	if rotation != 90 && rotation != 270 || displayWidth <= 0 || displayHeight <= 0 {
+		return 0
+	}
+	if (imgWidth > imgHeight) == (displayWidth > displayHeight) {
+		return rotation
+	}
+	return 0
+}
+
+// rotateImage rotate the image in natural orientation to the display with rotation,
+// uses the same mapping as TouchRequest.naturalPercent
+func rotateImage(img image.Image, rotation int) image.Image {
+	if rotation != 90 && rotation != 180 && rotation != 270 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if rotation != 180 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch rotation {
+			case 90:
+				sx, sy = w-1-y, x
+			case 180:
+				sx, sy = w-1-x, h-1-y
+			case 270:
+				sx, sy = y, h-1-x
+			}
+			dst.SetNRGBA(x, y, nrgbaAt(img, bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// transformScreenshot apply rotate, crop, scale and encode in order, return the data and content type.
+// rotation and display size (natural orientation) are used by auto rotate.
+func transformScreenshot(data []byte, opts ScreenshotOptions, rotation, displayWidth, displayHeight int) ([]byte, string, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "decode screenshot")
+	}
+	if opts.Format != "" {
+		format = opts.Format
+	}
+	degrees := opts.Rotate
+	if opts.AutoRotate {
+		degrees = autoRotation(img.Bounds().Dx(), img.Bounds().Dy(), displayWidth, displayHeight, rotation)
+	}
+	img = rotateImage(img, degrees)
+	if !opts.Crop.Empty() {
+		bounds := img.Bounds()
+		rect := opts.Crop.Add(bounds.Min).Intersect(bounds)
+		if rect.Empty() {
+			return nil, "", errCropOutside
+		}
+		cropped := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+		for y := 0; y < rect.Dy(); y++ {
+			for x := 0; x < rect.Dx(); x++ {
+				cropped.SetNRGBA(x, y, nrgbaAt(img, rect.Min.X+x, rect.Min.Y+y))
+			}
+		}
+		img = cropped
+	}
+	img = resizeImage(img, opts.MaxWidth, opts.MaxHeight)
+	buf := bytes.NewBuffer(nil)
+	if err := encodeImage(buf, img, format, opts.Quality); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), imageContentType(format), nil
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScreenshotOptions(t *testing.T) {
+	opts, err := parseScreenshotOptions(url.Values{})
+	assert.NoError(t, err)
+	assert.True(t, opts.IsZero())
+
+	opts, err = parseScreenshotOptions(url.Values{
+		"format":    {"JPEG"},
+		"quality":   {"60"},
+		"size":      {"800"},
+		"maxHeight": {"400"},
+		"crop":      {"10,20,100,50"},
+		"rotate":    {"auto"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ScreenshotOptions{
+		Format:     "jpeg",
+		Quality:    60,
+		MaxWidth:   800,
+		MaxHeight:  400,
+		Crop:       image.Rect(10, 20, 110, 70),
+		AutoRotate: true,
+	}, opts)
+
+	opts, err = parseScreenshotOptions(url.Values{"rotate": {"270"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 270, opts.Rotate)
+
+	for _, query := range []url.Values{
+		{"format": {"gif"}},
+		{"quality": {"101"}},
+		{"quality": {"0"}},
+		{"size": {"-1"}},
+		{"maxWidth": {"abc"}},
+		{"crop": {"1,2,3"}},
+		{"crop": {"0,0,0,10"}},
+		{"rotate": {"45"}},
+	} {
+		_, err := parseScreenshotOptions(query)
+		assert.Error(t, err, query.Encode())
+	}
+}
+
+func TestAutoRotation(t *testing.T) {
+	assert.Equal(t, 90, autoRotation(1080, 1920, 1080, 1920, 90))
+	assert.Equal(t, 0, autoRotation(1920, 1080, 1080, 1920, 90))  // already rotated
+	assert.Equal(t, 0, autoRotation(1080, 1920, 1080, 1920, 0))   // portrait
+	assert.Equal(t, 0, autoRotation(1080, 1920, 1080, 1920, 180)) // can not detect
+	assert.Equal(t, 0, autoRotation(1080, 1920, 0, 0, 90))        // display unknown
+}
+
+func TestRotateImage(t *testing.T) {
+	// 2x1 image: red, green
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	red := color.NRGBA{255, 0, 0, 255}
+	green := color.NRGBA{0, 255, 0, 255}
+	img.SetNRGBA(0, 0, red)
+	img.SetNRGBA(1, 0, green)
+
+	rotated := rotateImage(img, 90)
+	assert.Equal(t, image.Rect(0, 0, 1, 2), rotated.Bounds())
+	assert.Equal(t, green, nrgbaAt(rotated, 0, 0))
+	assert.Equal(t, red, nrgbaAt(rotated, 0, 1))
+
+	rotated = rotateImage(img, 180)
+	assert.Equal(t, green, nrgbaAt(rotated, 0, 0))
+	assert.Equal(t, red, nrgbaAt(rotated, 1, 0))
+
+	rotated = rotateImage(img, 270)
+	assert.Equal(t, red, nrgbaAt(rotated, 0, 0))
+	assert.Equal(t, green, nrgbaAt(rotated, 0, 1))
+
+	assert.Equal(t, img, rotateImage(img, 0))
+}
+
+func TestTransformScreenshot(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 100; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	png.Encode(buf, img)
+
+	// keep original format
+	data, contentType, err := transformScreenshot(buf.Bytes(), ScreenshotOptions{MaxWidth: 50, MaxHeight: 50}, 0, 100, 200)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+	out, err := png.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 25, 50), out.Bounds())
+
+	// rotate, then crop, then encode as jpeg
+	opts := ScreenshotOptions{Format: "jpeg", Quality: 90, AutoRotate: true, Crop: image.Rect(150, 0, 250, 10)}
+	data, contentType, err = transformScreenshot(buf.Bytes(), opts, 90, 100, 200)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+	out, err = jpeg.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 50, 10), out.Bounds()) // clipped to the 200x100 rotated image
+
+	_, _, err = transformScreenshot(buf.Bytes(), ScreenshotOptions{Crop: image.Rect(300, 300, 310, 310)}, 0, 100, 200)
+	assert.Equal(t, errCropOutside, err)
+
+	_, _, err = transformScreenshot([]byte("not an image"), ScreenshotOptions{Format: "png"}, 0, 0, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// a finished capture is reused by requests arrive within this time after it started
+	screenshotCoalesceWindow = 100 * time.Millisecond
+	// latency percentiles are computed from this many latest samples
+	screenshotMetricsSamples = 1000
+)
+
+type screenshotCall struct {
+	done     chan struct{}
+	started  time.Time
+	finished bool // guarded by ScreenshotCapturer.mu
+	data     []byte
+	method   string
+	err      error
+}
+
+type screenshotSample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// ScreenshotCapturer coalesce concurrent screenshot requests. Requests arrive while a capture is running
+// wait for that capture instead of starting a new one, and the result is reused by requests arrive
+// within the window after the capture started.
+// The data returned is shared by these requests, and must not be modified.
+type ScreenshotCapturer struct {
+	mu      sync.Mutex
+	window  time.Duration
+	capture func(useMinicap bool) ([]byte, string, error)
+	calls   map[bool]*screenshotCall // the latest capture of useMinicap
+
+	requests       int64
+	captures       int64
+	coalesced      int64
+	errors         int64
+	methods        map[string]int64
+	captureSamples []screenshotSample
+	requestSamples []screenshotSample
+}
+
+func NewScreenshotCapturer(window time.Duration, capture func(useMinicap bool) ([]byte, string, error)) *ScreenshotCapturer {
+	return &ScreenshotCapturer{
+		window:  window,
+		capture: capture,
+		calls:   make(map[bool]*screenshotCall),
+		methods: make(map[string]int64),
+	}
+}
+
+var screenshotCapturer = NewScreenshotCapturer(screenshotCoalesceWindow, takeScreenshot)
+
+// Take return a screenshot started while running or not older than the window before called, and the method used
+func (c *ScreenshotCapturer) Take(useMinicap bool) (data []byte, method string, err error) {
+	start := time.Now()
+	c.mu.Lock()
+	c.requests++
+	call := c.calls[useMinicap]
+	if call != nil && (!call.finished || start.Sub(call.started) <= c.window) {
+		c.coalesced++
+		c.mu.Unlock()
+		<-call.done
+	} else {
+		call = &screenshotCall{done: make(chan struct{}), started: start}
+		c.calls[useMinicap] = call
+		c.mu.Unlock()
+
+		call.data, call.method, call.err = c.capture(useMinicap)
+
+		c.mu.Lock()
+		call.finished = true
+		close(call.done)
+		c.captures++
+		if call.err != nil {
+			c.errors++
+		} else {
+			c.methods[call.method]++
+		}
+		c.captureSamples = appendSample(c.captureSamples, screenshotSample{time.Now(), time.Since(start)})
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	c.requestSamples = appendSample(c.requestSamples, screenshotSample{time.Now(), time.Since(start)})
+	c.mu.Unlock()
+	return call.data, call.method, call.err
+}
+
+func appendSample(samples []screenshotSample, sample screenshotSample) []screenshotSample {
+	samples = append(samples, sample)
+	if over := len(samples) - screenshotMetricsSamples; over > 0 {
+		samples = append([]screenshotSample(nil), samples[over:]...)
+	}
+	return samples
+}
+
+// LatencyMetrics in milliseconds
+type LatencyMetrics struct {
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	Max float64 `json:"max"`
+}
+
+func latencyMetrics(samples []screenshotSample) LatencyMetrics {
+	if len(samples) == 0 {
+		return LatencyMetrics{}
+	}
+	latencies := make([]time.Duration, len(samples))
+	var total time.Duration
+	for i, sample := range samples {
+		latencies[i] = sample.latency
+		total += sample.latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	percentile := func(p int) float64 {
+		return ms(latencies[(len(latencies)-1)*p/100])
+	}
+	return LatencyMetrics{
+		Avg: ms(total / time.Duration(len(latencies))),
+		P50: percentile(50),
+		P95: percentile(95),
+		Max: ms(latencies[len(latencies)-1]),
+	}
+}
+
+// perSecond count samples in the last minute
+func perSecond(samples []screenshotSample, now time.Time) float64 {
+	n := 0
+	for i := len(samples) - 1; i >= 0 && now.Sub(samples[i].at) <= time.Minute; i-- {
+		n++
+	}
+	return float64(n) / 60
+}
+
+// ScreenshotMetrics is rendered by GET /screenshot/metrics, latency is of the latest samples,
+// and throughput is the average of the last minute
+type ScreenshotMetrics struct {
+	Requests          int64            `json:"requests"`
+	Captures          int64            `json:"captures"`
+	Coalesced         int64            `json:"coalesced"` // requests served by a capture started by others
+	Errors            int64            `json:"errors"`
+	Methods           map[string]int64 `json:"methods"` // successful captures of each method
+	CaptureLatency    LatencyMetrics   `json:"captureLatencyMs"`
+	RequestLatency    LatencyMetrics   `json:"requestLatencyMs"`
+	CapturesPerSecond float64          `json:"capturesPerSecond"`
+	RequestsPerSecond float64          `json:"requestsPerSecond"`
+}
+
+func (c *ScreenshotCapturer) Metrics() ScreenshotMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	methods := make(map[string]int64, len(c.methods))
+	for method, n := range c.methods {
+		methods[method] = n
+	}
+	return ScreenshotMetrics{
+		Requests:          c.requests,
+		Captures:          c.captures,
+		Coalesced:         c.coalesced,
+		Errors:            c.errors,
+		Methods:           methods,
+		CaptureLatency:    latencyMetrics(c.captureSamples),
+		RequestLatency:    latencyMetrics(c.requestSamples),
+		CapturesPerSecond: perSecond(c.captureSamples, now),
+		RequestsPerSecond: perSecond(c.requestSamples, now),
+	}
+}
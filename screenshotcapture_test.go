@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScreenshotCapturerCoalesce(t *testing.T) {
+	var captures int32
+	c := NewScreenshotCapturer(100*time.Millisecond, func(useMinicap bool) ([]byte, string, error) {
+		n := atomic.AddInt32(&captures, 1)
+		time.Sleep(50 * time.Millisecond)
+		return []byte{byte(n)}, "screencap", nil
+	})
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, method, err := c.Take(true)
+			assert.NoError(t, err)
+			assert.Equal(t, "screencap", method)
+			results[i] = data
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&captures))
+	for _, data := range results {
+		assert.Equal(t, []byte{1}, data)
+	}
+
+	// useMinicap=false is captured separately
+	data, _, _ := c.Take(false)
+	assert.Equal(t, []byte{2}, data)
+
+	// out of the window
+	time.Sleep(100 * time.Millisecond)
+	data, _, _ = c.Take(true)
+	assert.Equal(t, []byte{3}, data)
+
+	metrics := c.Metrics()
+	assert.Equal(t, int64(12), metrics.Requests)
+	assert.Equal(t, int64(3), metrics.Captures)
+	assert.Equal(t, int64(9), metrics.Coalesced)
+	assert.Equal(t, int64(0), metrics.Errors)
+	assert.Equal(t, map[string]int64{"screencap": 3}, metrics.Methods)
+	assert.True(t, metrics.CaptureLatency.P50 >= 50, "%+v", metrics.CaptureLatency)
+	assert.InDelta(t, 3.0/60, metrics.CapturesPerSecond, 0.001)
+	assert.InDelta(t, 12.0/60, metrics.RequestsPerSecond, 0.001)
+}
+
+func TestScreenshotCapturerError(t *testing.T) {
+	c := NewScreenshotCapturer(0, func(useMinicap bool) ([]byte, string, error) {
+		return nil, "screencap", errors.New("screencap failed")
+	})
+	_, _, err := c.Take(true)
+	assert.Error(t, err)
+	metrics := c.Metrics()
+	assert.Equal(t, int64(1), metrics.Errors)
+	assert.Len(t, metrics.Methods, 0)
+}
+
+func TestLatencyMetrics(t *testing.T) {
+	assert.Equal(t, LatencyMetrics{}, latencyMetrics(nil))
+
+	var samples []screenshotSample
+	for i := 100; i >= 1; i-- {
+		samples = append(samples, screenshotSample{latency: time.Duration(i) * time.Millisecond})
+	}
+	assert.Equal(t, LatencyMetrics{Avg: 50.5, P50: 50, P95: 95, Max: 100}, latencyMetrics(samples))
+
+	for i := 0; i < screenshotMetricsSamples; i++ {
+		samples = appendSample(samples, screenshotSample{})
+	}
+	assert.Len(t, samples, screenshotMetricsSamples)
+}
+
+func TestScreenshotCapturerSlowCapture(t *testing.T) {
+	var captures int32
+	release := make(chan struct{})
+	c := NewScreenshotCapturer(50*time.Millisecond, func(useMinicap bool) ([]byte, string, error) {
+		n := atomic.AddInt32(&captures, 1)
+		<-release // slower than the window, like screencap
+		return []byte{byte(n)}, "screencap", nil
+	})
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = c.Take(true)
+		}(i)
+		time.Sleep(30 * time.Millisecond) // later requests arrive after the window
+	}
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&captures), "requests should wait the running capture")
+	for _, data := range results {
+		assert.Equal(t, []byte{1}, data)
+	}
+	assert.Equal(t, int64(4), c.Metrics().Coalesced)
+
+	// finished and out of the window
+	data, _, _ := c.Take(true)
+	assert.Equal(t, []byte{2}, data)
+}
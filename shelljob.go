@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// output more than this will drop the oldest part
+const shellJobOutputMaxSize = 1 << 20 // 1MB
+
+// outputBuffer keep the latest maxSize bytes written, and remember the absolute offset
+// so that client can read output incrementally
+type outputBuffer struct {
+	mu      sync.Mutex
+	data    []byte
+	offset  int64 // absolute offset of data[0]
+	maxSize int
+}
+
+func newOutputBuffer(maxSize int) *outputBuffer {
+	return &outputBuffer{maxSize: maxSize}
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data = append(b.data, p...)
+	if over := len(b.data) - b.maxSize; over > 0 {
+		b.data = append([]byte(nil), b.data[over:]...)
+		b.offset += int64(over)
+	}
+	return len(p), nil
+}
+
+// Since return data after offset and the offset for next read.
+// If the offset is already dropped, data starts from the oldest kept byte.
+func (b *outputBuffer) Since(offset int64) (data []byte, next int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	end := b.offset + int64(len(b.data))
+	if offset < b.offset {
+		offset = b.offset
+	}
+	if offset > end {
+		offset = end
+	}
+	data = append([]byte(nil), b.data[offset-b.offset:]...)
+	return data, end
+}
+
+// ShellJob is a shell command running in background, started by POST /shell/background
+type ShellJob struct {
+	ID      string
+	Command string
+	Stdout  *outputBuffer
+	Stderr  *outputBuffer
+
+	cmd  *exec.Cmd
+	done chan struct{}
+
+	mu         sync.Mutex
+	exitCode   int
+	err        error
+	startedAt  time.Time
+	finishedAt time.Time
+}
+
+func (j *ShellJob) Pid() int {
+	return j.cmd.Process.Pid
+}
+
+func (j *ShellJob) Running() bool {
+	select {
+	case <-j.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Done is closed when command exited
+func (j *ShellJob) Done() <-chan struct{} {
+	return j.done
+}
+
+func (j *ShellJob) Signal(sig os.Signal) error {
+	if !j.Running() {
+		return errors.New("shell job " + j.ID + " already exited")
+	}
+	return signalProcessGroup(j.cmd.Process, sig)
+}
+
+// Info return data for json render
+func (j *ShellJob) Info() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	data := map[string]interface{}{
+		"id":        j.ID,
+		"command":   j.Command,
+		"pid":       j.cmd.Process.Pid,
+		"running":   j.finishedAt.IsZero(),
+		"startedAt": j.startedAt,
+	}
+	if !j.finishedAt.IsZero() {
+		data["exitCode"] = j.exitCode
+		data["finishedAt"] = j.finishedAt
+		if j.err != nil {
+			data["error"] = j.err.Error()
+		}
+	}
+	return data
+}
+
+// ShellJobManager keep track of background shell commands.
+// Every command runs in its own process group, so signals reach the children of pipelines and loops.
+// Commands are not killed when atx-agent quit, finished jobs are removed after backgroundJobKeepDuration.
+type ShellJobManager struct {
+	mu   sync.Mutex
+	n    int
+	jobs map[string]*ShellJob
+}
+
+func NewShellJobManager() *ShellJobManager {
+	return &ShellJobManager{
+		jobs: make(map[string]*ShellJob),
+	}
+}
+
+func (m *ShellJobManager) Start(command string) (*ShellJob, error) {
+	job := &ShellJob{
+		Command: command,
+		Stdout:  newOutputBuffer(shellJobOutputMaxSize),
+		Stderr:  newOutputBuffer(shellJobOutputMaxSize),
+		done:    make(chan struct{}),
+	}
+	cmd, err := Command{
+		Args:         []string{command},
+		Shell:        true,
+		Stdout:       job.Stdout,
+		Stderr:       job.Stderr,
+		ProcessGroup: true,
+	}.StartBackground()
+	if err != nil {
+		return nil, err
+	}
+	job.cmd = cmd
+	job.startedAt = time.Now()
+
+	m.mu.Lock()
+	m.removeExpired()
+	m.n++
+	job.ID = strconv.Itoa(m.n)
+	m.jobs[job.ID] = job
+	m.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		job.mu.Lock()
+		job.exitCode = cmdError2Code(err)
+		if _, ok := err.(*exec.ExitError); !ok {
+			job.err = err
+		}
+		job.finishedAt = time.Now()
+		job.mu.Unlock()
+		close(job.done)
+		log.Printf("shell job %s(pid=%d) exited with code %d", job.ID, cmd.Process.Pid, job.exitCode)
+	}()
+	return job, nil
+}
+
+func (m *ShellJobManager) Get(id string) (*ShellJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// List return all jobs order by id
+func (m *ShellJobManager) List() []*ShellJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeExpired()
+	jobs := make([]*ShellJob, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		a, _ := strconv.Atoi(jobs[i].ID)
+		b, _ := strconv.Atoi(jobs[j].ID)
+		return a < b
+	})
+	return jobs
+}
+
+// Remove kill the command if still running, and forget it
+func (m *ShellJobManager) Remove(id string) error {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	delete(m.jobs, id)
+	m.mu.Unlock()
+	if !ok {
+		return errors.New("shell job " + strconv.Quote(id) + " not found")
+	}
+	if job.Running() {
+		signalProcessGroup(job.cmd.Process, os.Kill)
+	}
+	return nil
+}
+
+// removeExpired should be called with m.mu locked
+func (m *ShellJobManager) removeExpired() {
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		expired := !job.finishedAt.IsZero() && time.Since(job.finishedAt) > backgroundJobKeepDuration
+		job.mu.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+// parseSignal accept signal name or number, eg: TERM, SIGTERM, 15
+func parseSignal(name string) (syscall.Signal, error) {
+	if num, err := strconv.Atoi(name); err == nil {
+		return syscall.Signal(num), nil
+	}
+	name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	return 0, errors.New("unknown signal: " + name)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputBuffer(t *testing.T) {
+	b := newOutputBuffer(8)
+	b.Write([]byte("hello"))
+	data, next := b.Since(0)
+	assert.Equal(t, "hello", string(data))
+	assert.Equal(t, int64(5), next)
+
+	b.Write([]byte(" world"))
+	data, next = b.Since(next)
+	assert.Equal(t, " world", string(data))
+	assert.Equal(t, int64(11), next)
+
+	// "hel" is dropped
+	data, _ = b.Since(0)
+	assert.Equal(t, "lo world", string(data))
+}
+
+func TestShellJobManager(t *testing.T) {
+	m := NewShellJobManager()
+	job, err := m.Start("echo hello; echo oops >&2; exit 3")
+	assert.Nil(t, err)
+	select {
+	case <-job.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("shell job should exit")
+	}
+	stdout, _ := job.Stdout.Since(0)
+	stderr, _ := job.Stderr.Since(0)
+	assert.Equal(t, "hello\n", string(stdout))
+	assert.Equal(t, "oops\n", string(stderr))
+	assert.Equal(t, 3, job.Info()["exitCode"])
+	assert.NotNil(t, job.Signal(syscall.SIGTERM))
+
+	assert.Nil(t, m.Remove(job.ID))
+	assert.NotNil(t, m.Remove(job.ID))
+}
+
+func TestParseSignal(t *testing.T) {
+	sig, err := parseSignal("sigterm")
+	assert.Nil(t, err)
+	assert.Equal(t, syscall.SIGTERM, sig)
+	sig, err = parseSignal("9")
+	assert.Nil(t, err)
+	assert.Equal(t, syscall.SIGKILL, sig)
+	_, err = parseSignal("NOPE")
+	assert.NotNil(t, err)
+}
+
+func TestShellJobKillGroup(t *testing.T) {
+	m := NewShellJobManager()
+	// sleep and cat keep stdout open, the job is done only when they are killed too
+	job, err := m.Start("sleep 30 | cat")
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, job.Signal(syscall.SIGTERM))
+	select {
+	case <-job.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("children of the shell job should be killed")
+	}
+
+	job, err = m.Start("while true; do sleep 1; done")
+	assert.Nil(t, err)
+	assert.Nil(t, m.Remove(job.ID))
+	select {
+	case <-job.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("shell job should be killed when removed")
+	}
+}
+
+func TestShellJobExpire(t *testing.T) {
+	m := NewShellJobManager()
+	job, err := m.Start("true")
+	assert.Nil(t, err)
+	<-job.Done()
+	assert.Len(t, m.List(), 1)
+
+	job.mu.Lock()
+	job.finishedAt = time.Now().Add(-backgroundJobKeepDuration - time.Second)
+	job.mu.Unlock()
+	assert.Len(t, m.List(), 0)
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is not supported on windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup only signal p on windows
+func signalProcessGroup(p *os.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
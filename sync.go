@@ -0,0 +1,193 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errSyncChecksum = errors.New("checksum mismatch")
+
+// SyncEntry is a file in sync manifest, path is relative to the sync directory.
+// Only one checksum is needed, the file is compared by size when none is given.
+type SyncEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5,omitempty"`
+	SHA1   string `json:"sha1,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func (e SyncEntry) checksum() (algorithm, sum string) {
+	switch {
+	case e.SHA256 != "":
+		return "sha256", e.SHA256
+	case e.SHA1 != "":
+		return "sha1", e.SHA1
+	case e.MD5 != "":
+		return "md5", e.MD5
+	}
+	return "", ""
+}
+
+// SyncManifest is posted by client to /sync/{dir}
+type SyncManifest struct {
+	Files  []SyncEntry `json:"files"`
+	Delete bool        `json:"delete"` // delete files not in manifest
+}
+
+// SyncResult tell client which files need to upload
+type SyncResult struct {
+	Missing  []string `json:"missing"`
+	Stale    []string `json:"stale"`
+	Extra    []string `json:"extra"`   // files on device but not in manifest
+	Deleted  []string `json:"deleted"` // extra files deleted
+	UpToDate int      `json:"upToDate"`
+}
+
+// internalTempPrefixes are hidden files created while uploading, syncing, copying or moving
+var internalTempPrefixes = []string{".atx-upload-", ".atx-sync-", ".atx-transfer-"}
+
+// isInternalTempFile report whether name is a temp file of atx-agent, which is never reported as extra
+func isInternalTempFile(name string) bool {
+	for _, prefix := range internalTempPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffManifest compare realdir with manifest, extra files are deleted when manifest.Delete is true
+func diffManifest(realdir string, manifest SyncManifest) (*SyncResult, error) {
+	result := &SyncResult{
+		Missing: []string{},
+		Stale:   []string{},
+		Extra:   []string{},
+		Deleted: []string{},
+	}
+	wanted := make(map[string]bool, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		rel := path.Clean(filepath.ToSlash(entry.Path))
+		if rel == "." {
+			return nil, &SandboxError{Path: entry.Path, Reason: sandboxInvalidPath}
+		}
+		target, err := safeJoin(realdir, entry.Path)
+		if err != nil {
+			return nil, err
+		}
+		wanted[rel] = true
+
+		finfo, err := os.Stat(target)
+		if err != nil || !finfo.Mode().IsRegular() {
+			result.Missing = append(result.Missing, rel)
+			continue
+		}
+		if finfo.Size() != entry.Size {
+			result.Stale = append(result.Stale, rel)
+			continue
+		}
+		if algorithm, sum := entry.checksum(); algorithm != "" {
+			sums, _, err := checksumCache.Checksums(target, []string{algorithm})
+			if err != nil {
+				return nil, err
+			}
+			if sums[algorithm] != strings.ToLower(sum) {
+				result.Stale = append(result.Stale, rel)
+				continue
+			}
+		}
+		result.UpToDate++
+	}
+
+	err := filepath.Walk(realdir, func(p string, finfo os.FileInfo, err error) error {
+		if err != nil {
+			if p == realdir && os.IsNotExist(err) {
+				return nil // everything is missing
+			}
+			return err
+		}
+		if p != realdir && isInternalTempFile(finfo.Name()) {
+			if finfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if finfo.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(realdir, p)
+		rel = filepath.ToSlash(rel)
+		if !wanted[rel] {
+			result.Extra = append(result.Extra, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Stale)
+	sort.Strings(result.Extra)
+	if manifest.Delete {
+		for _, rel := range result.Extra {
+			if err := os.Remove(filepath.Join(realdir, filepath.FromSlash(rel))); err != nil {
+				return nil, err
+			}
+			result.Deleted = append(result.Deleted, rel)
+		}
+	}
+	return result, nil
+}
+
+// receiveSyncFile write rd to rel under realdir, the file is replaced after checksum verified.
+// checksum format is the same as /download, eg: sha256:2c26b46b...
+func receiveSyncFile(realdir, rel string, rd io.Reader, checksum string, mode os.FileMode) (string, error) {
+	if path.Clean(filepath.ToSlash(rel)) == "." {
+		return "", &SandboxError{Path: rel, Reason: sandboxInvalidPath}
+	}
+	target, err := safeJoin(realdir, rel)
+	if err != nil {
+		return "", err
+	}
+	var algorithm, expect string
+	if checksum != "" {
+		if algorithm, expect, err = parseChecksum(checksum); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(target), ".atx-sync-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, rd); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if checksum != "" {
+		actual, err := fileHexDigest(tmp.Name(), algorithm)
+		if err != nil {
+			return "", err
+		}
+		if actual != expect {
+			return "", errors.Wrapf(errSyncChecksum, "%s %s expect %s but got %s", rel, algorithm, expect, actual)
+		}
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return "", err
+	}
+	return target, os.Rename(tmp.Name(), target)
+}
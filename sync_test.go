@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncManifest(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "sync")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	os.MkdirAll(filepath.Join(tmpdir, "img"), 0755)
+	ioutil.WriteFile(filepath.Join(tmpdir, "same.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpdir, "changed.txt"), []byte("world"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpdir, "img/old.png"), []byte("old"), 0644)
+
+	manifest := SyncManifest{Files: []SyncEntry{
+		{Path: "same.txt", Size: 5, MD5: "5D41402ABC4B2A76B9719D911017C592"},
+		{Path: "changed.txt", Size: 5, MD5: "5d41402abc4b2a76b9719d911017c592"},
+		{Path: "img/new.png", Size: 3},
+	}}
+	result, err := diffManifest(tmpdir, manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result.UpToDate)
+	assert.Equal(t, []string{"img/new.png"}, result.Missing)
+	assert.Equal(t, []string{"changed.txt"}, result.Stale)
+	assert.Equal(t, []string{"img/old.png"}, result.Extra)
+	assert.Empty(t, result.Deleted)
+	assert.True(t, fileExists(filepath.Join(tmpdir, "img/old.png")))
+
+	_, err = receiveSyncFile(tmpdir, "img/new.png", strings.NewReader("new"), "md5:00000000000000000000000000000000", 0644)
+	assert.Equal(t, errSyncChecksum, errors.Cause(err))
+	assert.False(t, fileExists(filepath.Join(tmpdir, "img/new.png")))
+	target, err := receiveSyncFile(tmpdir, "img/new.png", strings.NewReader("new"), "", 0600)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(tmpdir, "img/new.png"), target)
+	_, err = receiveSyncFile(tmpdir, "../evil.txt", strings.NewReader("evil"), "", 0644)
+	assert.IsType(t, &SandboxError{}, err)
+
+	manifest.Delete = true
+	result, err = diffManifest(tmpdir, manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, result.UpToDate)
+	assert.Equal(t, []string{"img/old.png"}, result.Deleted)
+	assert.False(t, fileExists(filepath.Join(tmpdir, "img/old.png")))
+
+	_, err = diffManifest(tmpdir, SyncManifest{Files: []SyncEntry{{Path: "../../etc/passwd"}}})
+	assert.IsType(t, &SandboxError{}, err)
+
+	// directory not exists yet
+	result, err = diffManifest(filepath.Join(tmpdir, "none"), manifest)
+	assert.Nil(t, err)
+	assert.Len(t, result.Missing, 3)
+}
+
+func TestSyncManifestSkipTempFiles(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "sync")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	os.MkdirAll(filepath.Join(tmpdir, "img/.atx-transfer-0123abcd"), 0755)
+	ioutil.WriteFile(filepath.Join(tmpdir, "a.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpdir, ".atx-upload-0123abcd.part"), []byte("uploading"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpdir, "img/.atx-sync-123456"), []byte("syncing"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpdir, "img/.atx-transfer-0123abcd/b.png"), []byte("copying"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpdir, "img/.hidden"), []byte("user file"), 0644)
+
+	manifest := SyncManifest{Files: []SyncEntry{{Path: "a.txt", Size: 5}}, Delete: true}
+	result, err := diffManifest(tmpdir, manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"img/.hidden"}, result.Extra)
+	assert.Equal(t, []string{"img/.hidden"}, result.Deleted)
+	assert.True(t, fileExists(filepath.Join(tmpdir, ".atx-upload-0123abcd.part")))
+	assert.True(t, fileExists(filepath.Join(tmpdir, "img/.atx-sync-123456")))
+	assert.True(t, fileExists(filepath.Join(tmpdir, "img/.atx-transfer-0123abcd/b.png")))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// termMessage is the JSON message used by websocket /term
+//
+// client -> server
+//   {"type": "input", "data": "ls\n"}
+//   {"type": "resize", "rows": 40, "cols": 120}
+//   {"type": "eof"} // close stdin, only when tty=false
+// binary message is treated as input
+//
+// server -> client
+//   {"type": "output", "data": "..."} // tty=true, stdout and stderr are mixed by terminal
+//   {"type": "stdout", "data": "..."} // tty=false
+//   {"type": "stderr", "data": "..."} // tty=false
+//   {"type": "exit", "exitCode": 0}
+//   {"type": "error", "data": "..."}
+type termMessage struct {
+	Type     string `json:"type"`
+	Data     string `json:"data,omitempty"`
+	Rows     uint16 `json:"rows,omitempty"`
+	Cols     uint16 `json:"cols,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+}
+
+// wsJSONWriter make websocket WriteJSON goroutine safe
+type wsJSONWriter struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (w *wsJSONWriter) WriteJSON(v interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ws.WriteJSON(v)
+}
+
+// utf8Writer send data as JSON string message, incomplete utf8 sequence at the
+// end of data is kept until next Write, so multi-byte chars are not broken
+type utf8Writer struct {
+	msgType string
+	out     *wsJSONWriter
+	mu      sync.Mutex
+	rest    []byte
+}
+
+func (w *utf8Writer) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	buf := append(w.rest, data...)
+	end := len(buf)
+	// a utf8 char is at most 4 bytes, only check the tail
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	w.rest = append([]byte(nil), buf[end:]...)
+	if end == 0 {
+		return len(data), nil
+	}
+	if err := w.out.WriteJSON(termMessage{Type: w.msgType, Data: string(buf[:end])}); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func parseTermSize(value string, defaultValue uint16) uint16 {
+	n, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || n == 0 {
+		return defaultValue
+	}
+	return uint16(n)
+}
+
+/*
+ # Interactive shell
+ ws://$DEVICE_URL/term?rows=24&cols=80
+
+ # Run command without pseudo-terminal, stdout and stderr are separated
+ ws://$DEVICE_URL/term?command=logcat&tty=false
+*/
+func handleTerminal(w http.ResponseWriter, r *http.Request) {
+	command := r.FormValue("command")
+	tty := r.FormValue("tty") != "false"
+	rows := parseTermSize(r.FormValue("rows"), 24)
+	cols := parseTermSize(r.FormValue("cols"), 80)
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("term websocket upgrade error:", err)
+		return
+	}
+	defer ws.Close()
+	out := &wsJSONWriter{ws: ws}
+
+	shell := (&Command{}).shellPath()
+	var cmd *exec.Cmd
+	if command == "" {
+		cmd = exec.Command(shell)
+	} else {
+		cmd = exec.Command(shell, "-c", command)
+	}
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+
+	var stdin io.WriteCloser
+	var resize func(rows, cols uint16) error
+	outputDone := make(chan bool)
+	if tty {
+		ptmx, err := startPty(cmd, rows, cols)
+		if err != nil {
+			out.WriteJSON(termMessage{Type: "error", Data: err.Error()})
+			return
+		}
+		defer ptmx.Close()
+		stdin = ptmx
+		resize = func(rows, cols uint16) error {
+			return resizePty(ptmx, rows, cols)
+		}
+		go func() {
+			io.Copy(&utf8Writer{msgType: "output", out: out}, ptmx)
+			close(outputDone)
+		}()
+	} else {
+		cmd.Stdout = &utf8Writer{msgType: "stdout", out: out}
+		cmd.Stderr = &utf8Writer{msgType: "stderr", out: out}
+		stdin, err = cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			out.WriteJSON(termMessage{Type: "error", Data: err.Error()})
+			return
+		}
+		close(outputDone) // cmd.Wait will wait output copied
+	}
+	log.Printf("term started, pid: %d, tty: %v, command: %q", cmd.Process.Pid, tty, command)
+
+	exitC := GoFunc(cmd.Wait)
+	go func() {
+		for {
+			msgType, data, err := ws.ReadMessage()
+			if err != nil {
+				// client gone, kill the process
+				cmd.Process.Kill()
+				return
+			}
+			if msgType == websocket.BinaryMessage {
+				stdin.Write(data)
+				continue
+			}
+			var msg termMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				out.WriteJSON(termMessage{Type: "error", Data: "invalid message: " + err.Error()})
+				continue
+			}
+			switch msg.Type {
+			case "input":
+				stdin.Write([]byte(msg.Data))
+			case "resize":
+				if resize == nil {
+					continue
+				}
+				if err := resize(msg.Rows, msg.Cols); err != nil {
+					out.WriteJSON(termMessage{Type: "error", Data: "resize: " + err.Error()})
+				}
+			case "eof":
+				if !tty {
+					stdin.Close()
+				}
+			default:
+				out.WriteJSON(termMessage{Type: "error", Data: "unknown message type: " + msg.Type})
+			}
+		}
+	}()
+
+	exitCode := cmdError2Code(<-exitC)
+	select {
+	case <-outputDone:
+	case <-time.After(time.Second): // background child process may still hold the pty
+	}
+	log.Printf("term exited, pid: %d, exitCode: %d", cmd.Process.Pid, exitCode)
+	out.WriteJSON(termMessage{Type: "exit", ExitCode: &exitCode})
+	out.mu.Lock()
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	out.mu.Unlock()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTermSize(t *testing.T) {
+	assert.Equal(t, uint16(40), parseTermSize("40", 24))
+	assert.Equal(t, uint16(24), parseTermSize("", 24))
+	assert.Equal(t, uint16(24), parseTermSize("0", 24))
+	assert.Equal(t, uint16(24), parseTermSize("-1", 24))
+	assert.Equal(t, uint16(80), parseTermSize("abc", 80))
+	assert.Equal(t, uint16(80), parseTermSize("65536", 80))
+	assert.Equal(t, uint16(65535), parseTermSize("65535", 80))
+}
+
+// dialTerm connect a websocket to handler, and return the client side
+func dialTerm(t *testing.T, handler http.HandlerFunc, query url.Values) (*websocket.Conn, func()) {
+	ts := httptest.NewServer(handler)
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/term?" + query.Encode()
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return ws, func() {
+		ws.Close()
+		ts.Close()
+	}
+}
+
+func TestUTF8Writer(t *testing.T) {
+	ws, closeFn := dialTerm(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		wr := &utf8Writer{msgType: "stdout", out: &wsJSONWriter{ws: conn}}
+		data := []byte("a你好") // 你 and 好 are 3 bytes each
+		for _, chunk := range [][]byte{data[:2], data[2:5], data[5:6], data[6:]} {
+			n, err := wr.Write(chunk)
+			assert.Nil(t, err)
+			assert.Equal(t, len(chunk), n)
+		}
+		conn.ReadMessage() // wait client to close
+	}, nil)
+	defer closeFn()
+
+	var messages []string
+	for i := 0; i < 3; i++ {
+		var msg termMessage
+		assert.Nil(t, ws.ReadJSON(&msg))
+		assert.Equal(t, "stdout", msg.Type)
+		messages = append(messages, msg.Data)
+	}
+	assert.Equal(t, []string{"a", "你", "好"}, messages)
+}
+
+// readTermOutput read messages until exit, return output joined and the exit code
+func readTermOutput(t *testing.T, ws *websocket.Conn) (output map[string]string, exitCode int) {
+	output = make(map[string]string)
+	for {
+		var msg termMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("read message: %v, output: %v", err, output)
+		}
+		switch msg.Type {
+		case "exit":
+			if assert.NotNil(t, msg.ExitCode) {
+				exitCode = *msg.ExitCode
+			}
+			return
+		case "error":
+			t.Fatalf("error message: %s", msg.Data)
+		default:
+			output[msg.Type] += msg.Data
+		}
+	}
+}
+
+func TestHandleTerminal(t *testing.T) {
+	ws, closeFn := dialTerm(t, handleTerminal, url.Values{
+		"command": {"echo hi; echo oops >&2; exit 3"},
+		"tty":     {"false"},
+	})
+	defer closeFn()
+	output, exitCode := readTermOutput(t, ws)
+	assert.Equal(t, "hi\n", output["stdout"])
+	assert.Equal(t, "oops\n", output["stderr"])
+	assert.Equal(t, 3, exitCode)
+
+	// stdin is closed by eof
+	ws, closeFn = dialTerm(t, handleTerminal, url.Values{"command": {"cat"}, "tty": {"false"}})
+	defer closeFn()
+	assert.Nil(t, ws.WriteJSON(termMessage{Type: "input", Data: "hello\n"}))
+	assert.Nil(t, ws.WriteJSON(termMessage{Type: "eof"}))
+	output, exitCode = readTermOutput(t, ws)
+	assert.Equal(t, "hello\n", output["stdout"])
+	assert.Equal(t, 0, exitCode)
+}
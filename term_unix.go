@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+func startPty(cmd *exec.Cmd, rows, cols uint16) (*os.File, error) {
+	return pty.StartWithSize(cmd, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+func resizePty(ptmx *os.File, rows, cols uint16) error {
+	return pty.Setsize(ptmx, &pty.Winsize{Rows: rows, Cols: cols})
+}
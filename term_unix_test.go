@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleTerminalTTY(t *testing.T) {
+	ws, closeFn := dialTerm(t, handleTerminal, url.Values{
+		"command": {"echo hi; exit 3"},
+		"rows":    {"30"},
+		"cols":    {"100"},
+	})
+	defer closeFn()
+	output, exitCode := readTermOutput(t, ws)
+	assert.Equal(t, "hi\r\n", output["output"]) // pty translate \n to \r\n
+	assert.Equal(t, 3, exitCode)
+}
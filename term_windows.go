@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+var errPtyNotSupported = errors.New("pty is not supported on windows")
+
+func startPty(cmd *exec.Cmd, rows, cols uint16) (*os.File, error) {
+	return nil, errPtyNotSupported
+}
+
+func resizePty(ptmx *os.File, rows, cols uint16) error {
+	return errPtyNotSupported
+}
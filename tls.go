@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	tlsEnabled      bool   // set by: server --tls
+	tlsCertFile     string // set by: server --tls-cert
+	tlsKeyFile      string // set by: server --tls-key
+	tlsClientCAFile string // set by: server --tls-client-ca
+	tlsInfo         *TLSInfo
+
+	defaultTLSCertFile = "/data/local/tmp/atx-agent.crt"
+	defaultTLSKeyFile  = "/data/local/tmp/atx-agent.key"
+)
+
+// TLSInfo is reported in /info, clients can pin the certificate with Fingerprint
+type TLSInfo struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint"` // sha256 of certificate DER, hex encoded
+	SelfSigned  bool   `json:"selfSigned"`
+	ClientAuth  bool   `json:"clientAuth"`
+}
+
+// certFingerprint return sha256 of DER in the format of AA:BB:..., same as openssl x509 -fingerprint -sha256
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// generateSelfSignedCert create an ECDSA P-256 certificate valid for 10 years
+func generateSelfSignedCert(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "atx-agent", Organization: []string{"openatx"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0755); err != nil {
+		return err
+	}
+	// key is written before certificate, so a half generated pair is regenerated next time
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		return err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ioutil.WriteFile(certFile, certPem, 0644)
+}
+
+// loadTLSConfig load certificate from certFile and keyFile.
+// When both are empty, the self-signed certificate under /data/local/tmp is used, and created if not exists.
+// clientCAFile enables mutual TLS, clients must present a certificate signed by it.
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, *TLSInfo, error) {
+	info := &TLSInfo{Enabled: true}
+	if certFile == "" && keyFile == "" {
+		certFile, keyFile = defaultTLSCertFile, defaultTLSKeyFile
+		info.SelfSigned = true
+		if !fileExists(certFile) || !fileExists(keyFile) {
+			log.Println("generate self-signed certificate", certFile)
+			hosts := []string{"localhost", "127.0.0.1"}
+			if ip, err := getOutboundIP(); err == nil {
+				hosts = append(hosts, ip.String())
+			}
+			if err := generateSelfSignedCert(certFile, keyFile, hosts); err != nil {
+				return nil, nil, errors.Wrap(err, "generate certificate")
+			}
+		}
+	} else if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("--tls-cert and --tls-key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "load certificate")
+	}
+	info.Fingerprint = certFingerprint(cert.Certificate[0])
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("no certificate found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		info.ClientAuth = true
+	}
+	return config, info, nil
+}
+
+// tlsListener serve TLS, and plain HTTP only for connections from loopback,
+// so that the apk and atx-agent itself can still talk to the server on device without certificates.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+	connC  chan net.Conn
+	doneC  chan struct{}
+	err    error
+	once   sync.Once
+}
+
+func newTLSListener(inner net.Listener, config *tls.Config) net.Listener {
+	l := &tlsListener{
+		Listener: inner,
+		config:   config,
+		connC:    make(chan net.Conn),
+		doneC:    make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *tlsListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			l.once.Do(func() { close(l.doneC) })
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake peek the first byte to tell TLS from plain HTTP, 0x16 is the TLS handshake record.
+// Plain HTTP is accepted only from loopback, and limited to plainLoopbackPaths by requireClientCert
+// when client certificates are required.
+func (l *tlsListener) handshake(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	brd := bufio.NewReader(conn)
+	head, err := brd.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var c net.Conn = &peekedConn{Conn: conn, rd: brd}
+	if head[0] == 0x16 {
+		c = tls.Server(c, l.config)
+	} else if !isLoopbackAddr(conn.RemoteAddr()) {
+		conn.Write([]byte("HTTP/1.0 400 Bad Request\r\n\r\nClient sent an HTTP request to an HTTPS server.\n"))
+		conn.Close()
+		return
+	}
+	select {
+	case l.connC <- c:
+	case <-l.doneC:
+		conn.Close()
+	}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connC:
+		return c, nil
+	case <-l.doneC:
+		return nil, l.err
+	}
+}
+
+type peekedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.rd.Read(p)
+}
+
+func isLoopbackAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+// plainLoopbackPaths can be requested with plain http from loopback when client certificates are required.
+// They are used by programs on device without the client certificate: server --stop, the health check
+// of /upgrade and the uiautomator apk.
+var plainLoopbackPaths = []string{"/version", "/stop", "/info/battery", "/info/rotation"}
+
+// requireClientCert wrap h to reject plain http requests except plainLoopbackPaths,
+// tlsListener accepts plain http only from loopback
+func requireClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil && !containsString(plainLoopbackPaths, r.URL.Path) {
+			log.Printf("reject plain http request %s %s from %s, client certificate required", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Client sent an HTTP request to an HTTPS server.", http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
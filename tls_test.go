@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSListener(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	certFile := filepath.Join(tmpdir, "agent.crt")
+	keyFile := filepath.Join(tmpdir, "agent.key")
+	assert.Nil(t, generateSelfSignedCert(certFile, keyFile, []string{"localhost", "127.0.0.1"}))
+
+	config, info, err := loadTLSConfig(certFile, keyFile, "")
+	assert.Nil(t, err)
+	assert.False(t, info.ClientAuth)
+	assert.Len(t, info.Fingerprint, 32*3-1)
+
+	_, _, err = loadTLSConfig(certFile, "", "")
+	assert.NotNil(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go server.Serve(newTLSListener(ln, config))
+	defer server.Close()
+	addr := ln.Addr().String()
+
+	// plain http is allowed from loopback
+	resp, err := http.Get("http://" + addr + "/")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	defer conn.Close()
+	peer := conn.ConnectionState().PeerCertificates[0]
+	assert.Equal(t, info.Fingerprint, certFingerprint(peer.Raw))
+}
+
+func TestTLSListenerClientAuthRejectPlain(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	certFile := filepath.Join(tmpdir, "agent.crt")
+	keyFile := filepath.Join(tmpdir, "agent.key")
+	assert.Nil(t, generateSelfSignedCert(certFile, keyFile, []string{"localhost", "127.0.0.1"}))
+
+	config, info, err := loadTLSConfig(certFile, keyFile, certFile)
+	assert.Nil(t, err)
+	assert.True(t, info.ClientAuth)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	stopped := make(chan bool, 1)
+	m := http.NewServeMux()
+	m.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	m.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		stopped <- r.Header.Get("Authorization") == "Bearer s3cret"
+		io.WriteString(w, "Finished!")
+	})
+	server := &http.Server{Handler: requireClientCert(m)}
+	go server.Serve(newTLSListener(ln, config))
+	defer server.Close()
+
+	// loopback does not skip client certificate
+	resp, err := http.Get("http://" + ln.Addr().String() + "/info")
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		resp.Body.Close()
+	}
+	// except the paths used by programs on device, eg: server --stop
+	assert.Nil(t, requestStop(ln.Addr().String(), "s3cret"))
+	assert.True(t, <-stopped)
+
+	// https without client certificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if resp, err := client.Get("https://" + ln.Addr().String() + "/stop"); err == nil {
+		resp.Body.Close()
+		t.Fatal("client certificate should be required")
+	}
+}
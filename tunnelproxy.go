@@ -21,6 +21,7 @@ func getDeviceInfo() *DeviceInfo {
 		Model:        getCachedProperty("ro.product.model"),
 		Version:      getCachedProperty("ro.build.version.release"),
 		AgentVersion: version,
+		TLS:          tlsInfo,
 	}
 	devInfo.Sdk, _ = strconv.Atoi(getCachedProperty("ro.build.version.sdk"))
 	devInfo.HWAddr, _ = androidutils.HWAddrWLAN()
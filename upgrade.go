@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	update "github.com/getlantern/go-update"
+	"github.com/pkg/errors"
+)
+
+var (
+	upgradeBaseURL       string // set by: server --upgrade-url
+	upgradePublicKeyPath string // set by: server --upgrade-pubkey
+)
+
+// SelfUpdater download new atx-agent binary and replace the running one.
+//
+// Files on the update server
+//
+//	{BaseURL}/latest                                   latest version, eg: 0.9.5
+//	{BaseURL}/{version}/atx-agent_linux_{arch}         binary, can be bzip2 compressed
+//	{BaseURL}/{version}/atx-agent_linux_{arch}.sha256  hex sha256 of the (uncompressed) binary
+//	{BaseURL}/{version}/atx-agent_linux_{arch}.sig     base64 RSA PKCS#1 v1.5 signature of the sha256,
+//	                                                   required only when PublicKeyPEM is set
+type SelfUpdater struct {
+	BaseURL      string
+	PublicKeyPEM []byte
+	TargetPath   string // empty means the running executable
+	HTTPClient   *http.Client
+	KillServer   func() error // kill the running servers before rollback, default is killAgentProcess
+}
+
+func NewSelfUpdater() (*SelfUpdater, error) {
+	if upgradeBaseURL == "" {
+		return nil, errors.New("upgrade url is not configured, start server with --upgrade-url")
+	}
+	u := &SelfUpdater{BaseURL: strings.TrimSuffix(upgradeBaseURL, "/")}
+	if upgradePublicKeyPath != "" {
+		pem, err := ioutil.ReadFile(upgradePublicKeyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "read upgrade public key")
+		}
+		u.PublicKeyPEM = pem
+	}
+	return u, nil
+}
+
+func (u *SelfUpdater) client() *http.Client {
+	if u.HTTPClient != nil {
+		return u.HTTPClient
+	}
+	return &http.Client{Timeout: 5 * time.Minute}
+}
+
+func (u *SelfUpdater) fetch(url string) ([]byte, error) {
+	resp, err := u.client().Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: http status %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (u *SelfUpdater) Target() (string, error) {
+	if u.TargetPath != "" {
+		return u.TargetPath, nil
+	}
+	return os.Executable()
+}
+
+// BackupPath is where the current binary is saved before update, used for rollback
+func (u *SelfUpdater) BackupPath() (string, error) {
+	target, err := u.Target()
+	if err != nil {
+		return "", err
+	}
+	return target + ".backup", nil
+}
+
+func (u *SelfUpdater) LatestVersion() (string, error) {
+	data, err := u.fetch(u.BaseURL + "/latest")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (u *SelfUpdater) binaryURL(version string) string {
+	arch := runtime.GOARCH
+	if arch == "arm" {
+		arch = "armv7"
+	}
+	return fmt.Sprintf("%s/%s/atx-agent_linux_%s", u.BaseURL, version, arch)
+}
+
+// Update verify and replace target binary, the old one is kept in BackupPath
+func (u *SelfUpdater) Update(version string) error {
+	target, err := u.Target()
+	if err != nil {
+		return err
+	}
+	backup, _ := u.BackupPath()
+	binURL := u.binaryURL(version)
+
+	sumData, err := u.fetch(binURL + ".sha256")
+	if err != nil {
+		return errors.Wrap(err, "fetch checksum")
+	}
+	fields := strings.Fields(string(sumData)) // support sha256sum output: <hex>  <filename>
+	if len(fields) == 0 {
+		return errors.New("empty checksum file")
+	}
+	checksum, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return errors.Wrap(err, "invalid checksum")
+	}
+	up := update.New().Target(target).VerifyChecksum(checksum)
+	if len(u.PublicKeyPEM) > 0 {
+		sigData, err := u.fetch(binURL + ".sig")
+		if err != nil {
+			return errors.Wrap(err, "fetch signature")
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigData)))
+		if err != nil {
+			return errors.Wrap(err, "invalid signature")
+		}
+		if _, err := up.VerifySignatureWithPEM(u.PublicKeyPEM); err != nil {
+			return errors.Wrap(err, "invalid public key")
+		}
+		up.VerifySignature(signature)
+	}
+
+	log.Printf("upgrade: download %s", binURL)
+	binData, err := u.fetch(binURL)
+	if err != nil {
+		return errors.Wrap(err, "fetch binary")
+	}
+	if err := copyFileAtomic(target, backup, 0755); err != nil {
+		return errors.Wrap(err, "backup")
+	}
+	err, errRecover := up.FromStream(bytes.NewReader(binData))
+	if errRecover != nil {
+		log.Printf("upgrade: recover failed: %v", errRecover)
+	}
+	return err
+}
+
+// copyFileAtomic copy src to dst through a temporary file, so dst is never half written
+func copyFileAtomic(src, dst string, mode os.FileMode) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// restartServerArgs return args to start server in daemon mode. --stop is removed, which would kill
+// the running server that waits the new one healthy.
+func restartServerArgs() []string {
+	args := []string{"server"}
+	hasDaemon := false
+	for _, arg := range os.Args[2:] {
+		switch arg {
+		case "-d", "--daemon":
+			hasDaemon = true
+		case "--stop":
+			continue
+		}
+		args = append(args, arg)
+	}
+	if !hasDaemon {
+		args = append(args, "-d")
+	}
+	return args
+}
+
+// agentPidHeader is set by /version, so the restarted server can be told from the old one
+const agentPidHeader = "X-Atx-Agent-Pid"
+
+// agentStatusOf return version and pid of the server listening on addr. Plain http from loopback is used,
+// which is allowed for /version even if client certificates are required.
+func agentStatusOf(addr string) (version string, pid int, err error) {
+	port := addr[strings.LastIndex(addr, ":")+1:]
+	client := http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Get("http://127.0.0.1:" + port + "/version")
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	pid, _ = strconv.Atoi(resp.Header.Get(agentPidHeader))
+	return strings.TrimSpace(string(data)), pid, err
+}
+
+// waitAgentHealthy wait until the server on addr is the expected version and not served by oldPid,
+// so a forced upgrade to the same version is not confused with the old server
+func waitAgentHealthy(addr, version string, oldPid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		v, pid, err := agentStatusOf(addr)
+		if err == nil && v == version && pid != 0 && pid != oldPid {
+			return true
+		}
+		if err == nil {
+			log.Printf("upgrade: expect version %s of a new process, got %s (pid=%d)", version, v, pid)
+		}
+		time.Sleep(time.Second)
+	}
+	return false
+}
+
+// Restart is called by the running server after it stopped listening. The new binary is started with args,
+// and the backup is restored and started instead when healthy return false.
+func (u *SelfUpdater) Restart(args []string, healthy func() bool) error {
+	target, err := u.Target()
+	if err != nil {
+		return err
+	}
+	backup, err := u.BackupPath()
+	if err != nil {
+		return err
+	}
+	startServer := func() error {
+		output, err := exec.Command(target, args...).CombinedOutput()
+		log.Printf("upgrade: %s %v output: %s", target, args, output)
+		return err
+	}
+	if err := startServer(); err != nil {
+		log.Printf("upgrade: start new version failed: %v", err)
+	} else if healthy() {
+		log.Printf("upgrade: new version is healthy")
+		return nil
+	}
+
+	log.Printf("upgrade: new version is not healthy, rollback")
+	killServer := u.KillServer
+	if killServer == nil {
+		killServer = killAgentProcess
+	}
+	if err := killServer(); err != nil {
+		log.Printf("upgrade: kill new version: %v", err)
+	}
+	if err := copyFileAtomic(backup, target, 0755); err != nil {
+		return errors.Wrap(err, "rollback")
+	}
+	return startServer()
+}
+
+// pendingUpgrade is set by /upgrade, the server restart after http server closed
+type pendingUpgrade struct {
+	updater *SelfUpdater
+	version string
+}
+
+// restartAfterUpgrade run in the daemon process after http server closed, then the process exits
+func restartAfterUpgrade(upgrade *pendingUpgrade) {
+	pid := os.Getpid()
+	err := upgrade.updater.Restart(restartServerArgs(), func() bool {
+		return waitAgentHealthy(listenAddr, upgrade.version, pid, 30*time.Second)
+	})
+	if err != nil {
+		log.Printf("upgrade: restart failed: %v", err)
+	}
+}
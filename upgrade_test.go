@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newUpgradeServer(t *testing.T, files map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+}
+
+func TestSelfUpdater(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "upgrade")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	target := filepath.Join(tmpdir, "atx-agent")
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+	pubDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})
+
+	newBinary := "new binary"
+	sum := sha256.Sum256([]byte(newBinary))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	assert.Nil(t, err)
+
+	arch := runtime.GOARCH
+	if arch == "arm" {
+		arch = "armv7"
+	}
+	binPath := "/1.0.0/atx-agent_linux_" + arch
+	files := map[string]string{
+		"/latest":           "1.0.0\n",
+		binPath:             newBinary,
+		binPath + ".sha256": hex.EncodeToString(sum[:]) + "  atx-agent\n",
+		binPath + ".sig":    base64.StdEncoding.EncodeToString(sig),
+	}
+	ts := newUpgradeServer(t, files)
+	defer ts.Close()
+
+	u := &SelfUpdater{BaseURL: ts.URL, PublicKeyPEM: pubPEM, TargetPath: target}
+	latest, err := u.LatestVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, "1.0.0", latest)
+
+	// bad checksum, target must be untouched
+	assert.Nil(t, ioutil.WriteFile(target, []byte("old binary"), 0755))
+	files[binPath+".sha256"] = hex.EncodeToString(make([]byte, 32))
+	assert.NotNil(t, u.Update("1.0.0"))
+	data, _ := ioutil.ReadFile(target)
+	assert.Equal(t, "old binary", string(data))
+
+	// bad signature
+	files[binPath+".sha256"] = hex.EncodeToString(sum[:])
+	files[binPath+".sig"] = base64.StdEncoding.EncodeToString(make([]byte, len(sig)))
+	assert.NotNil(t, u.Update("1.0.0"))
+	data, _ = ioutil.ReadFile(target)
+	assert.Equal(t, "old binary", string(data))
+
+	files[binPath+".sig"] = base64.StdEncoding.EncodeToString(sig)
+	assert.Nil(t, u.Update("1.0.0"))
+	data, _ = ioutil.ReadFile(target)
+	assert.Equal(t, newBinary, string(data))
+	backup, _ := u.BackupPath()
+	data, _ = ioutil.ReadFile(backup)
+	assert.Equal(t, "old binary", string(data))
+
+	assert.NotNil(t, u.Update("2.0.0")) // not exists
+}
+
+func TestWaitAgentHealthy(t *testing.T) {
+	pid := 100
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(agentPidHeader, strconv.Itoa(pid))
+		w.Write([]byte("1.0.0"))
+	}))
+	defer ts.Close()
+
+	v, p, err := agentStatusOf(ts.Listener.Addr().String())
+	assert.Nil(t, err)
+	assert.Equal(t, "1.0.0", v)
+	assert.Equal(t, 100, p)
+
+	// same version served by the old process, eg: upgrade with force=true
+	assert.False(t, waitAgentHealthy(ts.Listener.Addr().String(), "1.0.0", 100, 100*time.Millisecond))
+	assert.False(t, waitAgentHealthy(ts.Listener.Addr().String(), "2.0.0", 99, 100*time.Millisecond))
+	pid = 101
+	assert.True(t, waitAgentHealthy(ts.Listener.Addr().String(), "1.0.0", 100, 100*time.Millisecond))
+}
+
+func TestWaitAgentHealthyClientAuth(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "upgrade")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	certFile := filepath.Join(tmpdir, "agent.crt")
+	keyFile := filepath.Join(tmpdir, "agent.key")
+	assert.Nil(t, generateSelfSignedCert(certFile, keyFile, []string{"127.0.0.1"}))
+	config, _, err := loadTLSConfig(certFile, keyFile, certFile)
+	assert.Nil(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := &http.Server{Handler: requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(agentPidHeader, "101")
+		w.Write([]byte("1.0.0"))
+	}))}
+	go server.Serve(newTLSListener(ln, config))
+	defer server.Close()
+
+	assert.True(t, waitAgentHealthy(ln.Addr().String(), "1.0.0", 100, 100*time.Millisecond))
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfUpdaterRestartRollback(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "upgrade")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+	target := filepath.Join(tmpdir, "atx-agent")
+	started := filepath.Join(tmpdir, "started.txt")
+
+	// fake binaries record which one is started with args
+	fakeBinary := func(name string) []byte {
+		return []byte("#!/bin/sh\necho " + name + " \"$@\" >> " + started + "\n")
+	}
+	kills := 0
+	u := &SelfUpdater{TargetPath: target, KillServer: func() error {
+		kills++
+		return nil
+	}}
+	backup, _ := u.BackupPath()
+	assert.Nil(t, ioutil.WriteFile(target, fakeBinary("new"), 0755))
+	assert.Nil(t, ioutil.WriteFile(backup, fakeBinary("old"), 0755))
+
+	checks := 0
+	err = u.Restart([]string{"server", "-d"}, func() bool {
+		checks++
+		return false
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, checks)
+	assert.Equal(t, 1, kills)
+	data, _ := ioutil.ReadFile(started)
+	assert.Equal(t, "new server -d\nold server -d\n", string(data))
+	data, _ = ioutil.ReadFile(target)
+	assert.Equal(t, fakeBinary("old"), data, "backup should be restored")
+
+	// healthy, no rollback
+	os.Remove(started)
+	assert.Nil(t, ioutil.WriteFile(target, fakeBinary("new"), 0755))
+	assert.Nil(t, u.Restart([]string{"server", "-d"}, func() bool { return true }))
+	data, _ = ioutil.ReadFile(started)
+	assert.Equal(t, "new server -d\n", string(data))
+	data, _ = ioutil.ReadFile(target)
+	assert.Equal(t, fakeBinary("new"), data)
+	assert.Equal(t, 1, kills)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// upload sessions not updated for this long are removed with the partial file
+const uploadSessionExpire = 24 * time.Hour
+
+var (
+	errUploadOffsetMismatch = errors.New("offset mismatch")
+	errUploadIncomplete     = errors.New("upload is not complete")
+	errUploadTooLarge       = errors.New("data exceeds the declared size")
+	errUploadChecksum       = errors.New("sha256 mismatch")
+	errUploadBusy           = errors.New("upload is receiving data from another request")
+)
+
+// UploadSession is a resumable upload created by POST /uploads.
+// Data is written to a hidden part file in the directory of target, and renamed to target when finished,
+// so the target is replaced atomically.
+type UploadSession struct {
+	ID     string
+	Target string // path in request
+	Size   int64  // total size, -1 means unknown
+	Mode   os.FileMode
+	SHA256 string // expected checksum, can also be given when finish
+
+	realTarget string
+	partPath   string
+
+	mu        sync.Mutex
+	busy      bool // data is being appended, the lock is not held while copying
+	offset    int64
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+func (s *UploadSession) Offset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offset
+}
+
+// Info return data for json render
+func (s *UploadSession) Info() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"id":        s.ID,
+		"target":    s.Target,
+		"size":      s.Size,
+		"offset":    s.offset,
+		"createdAt": s.createdAt,
+		"updatedAt": s.updatedAt,
+	}
+}
+
+// Append write data from rd at offset, offset must be the current offset.
+// Data received before rd fails is kept, so the client can continue from the new offset.
+// Only one request can append at a time, others fail with errUploadBusy.
+func (s *UploadSession) Append(offset int64, rd io.Reader) (int64, error) {
+	s.mu.Lock()
+	if s.busy {
+		defer s.mu.Unlock()
+		return s.offset, errUploadBusy
+	}
+	if offset != s.offset {
+		defer s.mu.Unlock()
+		return s.offset, errUploadOffsetMismatch
+	}
+	s.busy = true
+	size := s.Size
+	s.mu.Unlock()
+
+	n, err := appendPartFile(s.partPath, offset, size, rd)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy = false
+	s.offset += n
+	s.updatedAt = time.Now()
+	return s.offset, err
+}
+
+// appendPartFile copy rd to path from offset, return bytes written, data over size is truncated
+func appendPartFile(path string, offset, size int64, rd io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if size >= 0 {
+		rd = io.LimitReader(rd, size-offset+1) // one more byte to detect too large
+	}
+	n, err := io.Copy(f, rd)
+	if size >= 0 && offset+n > size {
+		n = size - offset
+		f.Truncate(size)
+		err = errUploadTooLarge
+	}
+	return n, err
+}
+
+// finish verify size and checksum, then rename the part file to target.
+// The session is marked busy while hashing, so Offset and Info are not blocked by large files.
+func (s *UploadSession) finish(checksum string) error {
+	s.mu.Lock()
+	if s.busy {
+		s.mu.Unlock()
+		return errUploadBusy
+	}
+	if s.Size >= 0 && s.offset != s.Size {
+		defer s.mu.Unlock()
+		return errors.Wrapf(errUploadIncomplete, "received %d of %d bytes", s.offset, s.Size)
+	}
+	if checksum == "" {
+		checksum = s.SHA256
+	}
+	s.busy = true
+	s.mu.Unlock()
+
+	err := s.verifyAndRename(checksum)
+
+	s.mu.Lock()
+	s.busy = false
+	s.mu.Unlock()
+	return err
+}
+
+func (s *UploadSession) verifyAndRename(checksum string) error {
+	if checksum != "" {
+		actual, err := fileHexDigest(s.partPath, "sha256")
+		if err != nil {
+			return err
+		}
+		if actual != strings.ToLower(checksum) {
+			return errors.Wrapf(errUploadChecksum, "expect %s but got %s", checksum, actual)
+		}
+	}
+	if err := os.Chmod(s.partPath, s.Mode); err != nil {
+		return err
+	}
+	return os.Rename(s.partPath, s.realTarget)
+}
+
+func uploadErrorStatus(err error) int {
+	switch errors.Cause(err) {
+	case errUploadOffsetMismatch, errUploadIncomplete, errUploadBusy:
+		return http.StatusConflict
+	case errUploadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errUploadChecksum:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// UploadManager keep track of upload sessions
+type UploadManager struct {
+	mu       sync.Mutex
+	sessions map[string]*UploadSession
+}
+
+func NewUploadManager() *UploadManager {
+	return &UploadManager{
+		sessions: make(map[string]*UploadSession),
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Create start a session, target is the path reported to client, and realTarget is where file written
+func (m *UploadManager) Create(target, realTarget string, size int64, mode os.FileMode, checksum string) (*UploadSession, error) {
+	m.expire()
+	m.sweepPartFiles(filepath.Dir(realTarget))
+	if mode == 0 {
+		mode = 0644
+	}
+	session := &UploadSession{
+		ID:         randomID(),
+		Target:     target,
+		Size:       size,
+		Mode:       mode,
+		SHA256:     strings.ToLower(checksum),
+		realTarget: realTarget,
+		createdAt:  time.Now(),
+	}
+	session.updatedAt = session.createdAt
+	session.partPath = filepath.Join(filepath.Dir(realTarget), ".atx-upload-"+session.ID+".part")
+	if err := os.MkdirAll(filepath.Dir(realTarget), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(session.partPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	m.mu.Lock()
+	m.sessions[session.ID] = session
+	m.mu.Unlock()
+	return session, nil
+}
+
+func (m *UploadManager) Get(id string) (*UploadSession, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	return session, ok
+}
+
+// List return all sessions order by created time
+func (m *UploadManager) List() []*UploadSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]*UploadSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].createdAt.Before(sessions[j].createdAt)
+	})
+	return sessions
+}
+
+// Finish move the uploaded file to target. Session is removed when succeed or checksum mismatch,
+// and kept for other errors, eg: upload not complete
+func (m *UploadManager) Finish(id string, checksum string) error {
+	session, ok := m.Get(id)
+	if !ok {
+		return fmt.Errorf("upload %q not found", id)
+	}
+	err := session.finish(checksum)
+	if err == nil || errors.Cause(err) == errUploadChecksum {
+		m.Remove(id)
+	}
+	return err
+}
+
+// Remove forget the session and delete the partial file
+func (m *UploadManager) Remove(id string) error {
+	m.mu.Lock()
+	session, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("upload %q not found", id)
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	os.Remove(session.partPath)
+	return nil
+}
+
+func (m *UploadManager) expire() {
+	for _, session := range m.List() {
+		session.mu.Lock()
+		idle := time.Since(session.updatedAt)
+		busy := session.busy
+		session.mu.Unlock()
+		if idle > uploadSessionExpire && !busy {
+			log.Printf("upload %s to %s expired", session.ID, session.Target)
+			m.Remove(session.ID)
+		}
+	}
+}
+
+// sweepPartFiles remove part files in dir not updated for uploadSessionExpire and not owned by any session,
+// which are left when the agent restarted during uploads
+func (m *UploadManager) sweepPartFiles(dir string) {
+	paths, _ := filepath.Glob(filepath.Join(dir, ".atx-upload-*.part"))
+	for _, path := range paths {
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), ".atx-upload-"), ".part")
+		if _, ok := m.Get(id); ok {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() || time.Since(info.ModTime()) <= uploadSessionExpire {
+			continue
+		}
+		log.Printf("remove stale upload part file %s", path)
+		os.Remove(path)
+	}
+}
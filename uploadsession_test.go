@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// brokenReader return data then fail, like a dropped connection
+type brokenReader struct {
+	rd io.Reader
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	n, err := b.rd.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestUploadSession(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "uploads")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	content := "hello resumable upload"
+	sum := sha256.Sum256([]byte(content))
+	target := filepath.Join(tmpdir, "obb/main.obb")
+
+	uploads := NewUploadManager()
+	session, err := uploads.Create(target, target, int64(len(content)), 0600, "")
+	assert.Nil(t, err)
+
+	offset, err := session.Append(0, &brokenReader{strings.NewReader(content[:5])})
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(5), offset)
+
+	_, err = session.Append(0, strings.NewReader(content))
+	assert.Equal(t, errUploadOffsetMismatch, err)
+
+	offset, err = session.Append(5, strings.NewReader(content[5:10]))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), offset)
+
+	err = uploads.Finish(session.ID, "")
+	assert.Equal(t, 409, uploadErrorStatus(err))
+	_, ok := uploads.Get(session.ID)
+	assert.True(t, ok, "session is kept when not complete")
+
+	offset, err = session.Append(10, strings.NewReader(content[10:]+"extra"))
+	assert.Equal(t, errUploadTooLarge, err)
+	assert.Equal(t, int64(len(content)), offset)
+
+	assert.Nil(t, uploads.Finish(session.ID, hex.EncodeToString(sum[:])))
+	data, _ := ioutil.ReadFile(target)
+	assert.Equal(t, content, string(data))
+	finfo, _ := os.Stat(target)
+	assert.Equal(t, os.FileMode(0600), finfo.Mode().Perm())
+	_, ok = uploads.Get(session.ID)
+	assert.False(t, ok)
+
+	// checksum mismatch remove the session and keep the target untouched
+	session, _ = uploads.Create(target, target, -1, 0, strings.Repeat("0", 64))
+	session.Append(0, strings.NewReader("corrupted"))
+	err = uploads.Finish(session.ID, "")
+	assert.Equal(t, 422, uploadErrorStatus(err))
+	data, _ = ioutil.ReadFile(target)
+	assert.Equal(t, content, string(data))
+	files, _ := ioutil.ReadDir(filepath.Dir(target))
+	assert.Len(t, files, 1)
+}
+
+func TestUploadSessionBusy(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "uploads")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	uploads := NewUploadManager()
+	session, err := uploads.Create(filepath.Join(tmpdir, "a.txt"), filepath.Join(tmpdir, "a.txt"), -1, 0, "")
+	assert.Nil(t, err)
+
+	pr, pw := io.Pipe()
+	done := make(chan int64)
+	go func() {
+		offset, _ := session.Append(0, pr)
+		done <- offset
+	}()
+	pw.Write([]byte("hello"))
+
+	// the session is not locked while receiving data
+	assert.Equal(t, int64(0), session.Offset())
+	_, err = session.Append(0, strings.NewReader("world"))
+	assert.Equal(t, 409, uploadErrorStatus(err))
+	assert.Equal(t, errUploadBusy, uploads.Finish(session.ID, ""))
+
+	pw.Close()
+	assert.Equal(t, int64(5), <-done)
+	offset, err := session.Append(5, strings.NewReader(" world"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), offset)
+}
+
+func TestUploadSweepPartFiles(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "uploads")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	stale := filepath.Join(tmpdir, ".atx-upload-0123456789abcdef01234567.part")
+	recent := filepath.Join(tmpdir, ".atx-upload-76543210fedcba9876543210.part")
+	ioutil.WriteFile(stale, []byte("left by a restart"), 0600)
+	ioutil.WriteFile(recent, []byte("maybe in use"), 0600)
+	old := time.Now().Add(-uploadSessionExpire - time.Minute)
+	assert.Nil(t, os.Chtimes(stale, old, old))
+
+	uploads := NewUploadManager()
+	session, err := uploads.Create(filepath.Join(tmpdir, "a.txt"), filepath.Join(tmpdir, "a.txt"), -1, 0, "")
+	assert.Nil(t, err)
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(recent)
+	assert.Nil(t, err)
+
+	// part file of a session is kept however old it is
+	assert.Nil(t, os.Chtimes(session.partPath, old, old))
+	uploads.sweepPartFiles(tmpdir)
+	_, err = os.Stat(session.partPath)
+	assert.Nil(t, err)
+}
+
+func TestUploadsCORS(t *testing.T) {
+	handler := NewServer().httpServer.Handler
+	req := httptest.NewRequest("OPTIONS", "/uploads/0123", nil)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", "PATCH")
+	req.Header.Set("Access-Control-Request-Headers", "Upload-Offset")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "PATCH", rec.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Upload-Offset", rec.Header().Get("Access-Control-Allow-Headers"))
+
+	req = httptest.NewRequest("GET", "/uploads", nil)
+	req.Header.Set("Origin", "http://example.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Header().Get("Access-Control-Expose-Headers"), "Upload-Offset")
+	assert.Contains(t, rec.Header().Get("Access-Control-Expose-Headers"), "Upload-Length")
+}
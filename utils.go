@@ -46,6 +46,8 @@ type Command struct {
 	ShellQuote bool
 	Stdout     io.Writer
 	Stderr     io.Writer
+	// ProcessGroup start the command in a new process group, so that its children can be killed together
+	ProcessGroup bool
 }
 
 func NewCommand(args ...string) *Command {
@@ -89,6 +91,9 @@ func (c Command) newCommand() *exec.Cmd {
 	if c.Stderr != nil {
 		cmd.Stderr = c.Stderr
 	}
+	if c.ProcessGroup {
+		setProcessGroup(cmd)
+	}
 	return cmd
 }
 
@@ -105,13 +110,10 @@ func (c Command) Run() error {
 	return cmd.Run()
 }
 
-func (c Command) StartBackground() (pid int, err error) {
-	cmd := c.newCommand()
+// StartBackground start command without waiting, caller should call cmd.Wait to release resources
+func (c Command) StartBackground() (cmd *exec.Cmd, err error) {
+	cmd = c.newCommand()
 	err = cmd.Start()
-	if err != nil {
-		return
-	}
-	pid = cmd.Process.Pid
 	return
 }
 
@@ -658,14 +660,16 @@ func killProcessByName(processName string) bool {
 
 func getPackagePath(packageName string) (string, error) {
 	pmPathOutput, err := Command{
-		Args:  []string{"pm", "path", "com.github.uiautomator"},
+		Args:  []string{"pm", "path", packageName},
 		Shell: true,
 	}.CombinedOutputString()
 	if err != nil {
-		return "", err
+		return "", errors.Wrap(err, "package "+strconv.Quote(packageName)+" not found")
 	}
+	// split apks output multi lines, the first one is base.apk
+	pmPathOutput = strings.SplitN(strings.TrimSpace(pmPathOutput), "\n", 2)[0]
 	if !strings.HasPrefix(pmPathOutput, "package:") {
-		return "", errors.New("invalid pm path output: " + pmPathOutput)
+		return "", errors.New("package " + strconv.Quote(packageName) + " not found")
 	}
 	packagePath := strings.TrimSpace(pmPathOutput[len("package:"):])
 	return packagePath, nil
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Pure go lossless webp (VP8L) encoder
+// Ref: https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+//
+// Only subtract-green and a fixed left predictor transform are used, pixel runs
+// are encoded as backward references to the left pixel. Not the smallest output,
+// but fast and usually smaller than png for screenshots.
+
+const (
+	vp8lMaxSize          = 1 << 14
+	vp8lMaxCodeLength    = 15
+	vp8lMaxCLCodeLength  = 7
+	vp8lNumLiterals      = 256
+	vp8lNumLengthCodes   = 24
+	vp8lNumDistanceCodes = 40
+	vp8lMaxCopyLength    = 4096
+
+	vp8lTransformPredictor     = 0
+	vp8lTransformSubtractGreen = 2
+	vp8lPredictorModeL         = 1
+	vp8lPredictorSizeBits      = 9 // block size 512 pixels, the smallest predictor image
+	vp8lDistanceCodeLeft       = 2 // plane code (1, 0), the left pixel
+)
+
+var vp8lCodeLengthCodeOrder = []int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+type vp8lBitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+// writeBits write lowest n bits of v, n <= 32
+func (b *vp8lBitWriter) writeBits(v uint32, n uint) {
+	b.acc |= uint64(v) << b.nbits
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nbits -= 8
+	}
+}
+
+func (b *vp8lBitWriter) flush() {
+	if b.nbits > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nbits = 0, 0
+	}
+}
+
+// huffmanCodeLengths calculate code lengths no longer than maxLength.
+// Symbols with zero count get length 0, a single used symbol gets length 1.
+func huffmanCodeLengths(hist []uint32, maxLength int) []int {
+	counts := append([]uint32(nil), hist...)
+	for {
+		lengths, maxDepth := buildHuffmanTree(counts)
+		if maxDepth <= maxLength {
+			return lengths
+		}
+		// flatten the histogram until tree is short enough
+		for i, c := range counts {
+			if c > 1 {
+				counts[i] = (c + 1) / 2
+			}
+		}
+	}
+}
+
+func buildHuffmanTree(counts []uint32) (lengths []int, maxDepth int) {
+	type node struct {
+		count       uint32
+		left, right int // -1 for leaf
+	}
+	lengths = make([]int, len(counts))
+	nodes := make([]node, 0, 2*len(counts))
+	leafSymbols := make([]int, 0, len(counts))
+	for symbol, c := range counts {
+		if c > 0 {
+			leafSymbols = append(leafSymbols, symbol)
+		}
+	}
+	if len(leafSymbols) == 0 {
+		return lengths, 0
+	}
+	if len(leafSymbols) == 1 {
+		lengths[leafSymbols[0]] = 1
+		return lengths, 1
+	}
+	sort.SliceStable(leafSymbols, func(i, j int) bool {
+		return counts[leafSymbols[i]] < counts[leafSymbols[j]]
+	})
+	for _, symbol := range leafSymbols {
+		nodes = append(nodes, node{count: counts[symbol], left: -1, right: -1})
+	}
+	// two queue method: leaves [li, nLeaves), internal nodes [ii, len(nodes))
+	nLeaves := len(nodes)
+	li, ii := 0, nLeaves
+	pop := func() int {
+		if li < nLeaves && (ii >= len(nodes) || nodes[li].count <= nodes[ii].count) {
+			li++
+			return li - 1
+		}
+		ii++
+		return ii - 1
+	}
+	for (nLeaves-li)+(len(nodes)-ii) > 1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, left: a, right: b})
+	}
+	depths := make([]int, len(nodes))
+	for i := len(nodes) - 1; i >= nLeaves; i-- {
+		depths[nodes[i].left] = depths[i] + 1
+		depths[nodes[i].right] = depths[i] + 1
+	}
+	for i, symbol := range leafSymbols {
+		lengths[symbol] = depths[i]
+		if depths[i] > maxDepth {
+			maxDepth = depths[i]
+		}
+	}
+	return lengths, maxDepth
+}
+
+// canonicalCodes return codes with bits reversed, ready for LSB first writing
+func canonicalCodes(lengths []int) []uint32 {
+	var blCount [vp8lMaxCodeLength + 1]uint32
+	for _, l := range lengths {
+		if l > 0 {
+			blCount[l]++
+		}
+	}
+	var nextCode [vp8lMaxCodeLength + 1]uint32
+	code := uint32(0)
+	for bits := 1; bits <= vp8lMaxCodeLength; bits++ {
+		code = (code + blCount[bits-1]) << 1
+		nextCode[bits] = code
+	}
+	codes := make([]uint32, len(lengths))
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := nextCode[l]
+		nextCode[l]++
+		var rev uint32
+		for i := 0; i < l; i++ {
+			rev = rev<<1 | (c>>uint(i))&1
+		}
+		codes[symbol] = rev
+	}
+	return codes
+}
+
+type vp8lPrefixCode struct {
+	lengths []int
+	codes   []uint32
+}
+
+func (p *vp8lPrefixCode) write(bw *vp8lBitWriter, symbol int) {
+	bw.writeBits(p.codes[symbol], uint(p.lengths[symbol]))
+}
+
+// writePrefixCode build prefix code from histogram and write it to bw
+func writePrefixCode(bw *vp8lBitWriter, hist []uint32) *vp8lPrefixCode {
+	used := make([]int, 0, 2)
+	for symbol, c := range hist {
+		if c > 0 {
+			used = append(used, symbol)
+			if len(used) > 1 {
+				break
+			}
+		}
+	}
+	if len(used) <= 1 {
+		// simple code length code with one symbol, the symbol takes zero bits
+		symbol := 0
+		if len(used) == 1 {
+			symbol = used[0]
+		}
+		if symbol < vp8lNumLiterals {
+			bw.writeBits(1, 1) // simple code
+			bw.writeBits(0, 1) // num_symbols - 1
+			if symbol < 2 {
+				bw.writeBits(0, 1)
+				bw.writeBits(uint32(symbol), 1)
+			} else {
+				bw.writeBits(1, 1)
+				bw.writeBits(uint32(symbol), 8)
+			}
+			return &vp8lPrefixCode{lengths: make([]int, len(hist)), codes: make([]uint32, len(hist))}
+		}
+		// symbol >= 256 can not use simple code, add a fake symbol
+		hist = append([]uint32(nil), hist...)
+		hist[0] = 1
+	}
+
+	lengths := huffmanCodeLengths(hist, vp8lMaxCodeLength)
+	var clHist [vp8lMaxCodeLength + 4]uint32
+	for _, l := range lengths {
+		clHist[l]++
+	}
+	clLengths := huffmanCodeLengths(clHist[:], vp8lMaxCLCodeLength)
+	nUsed := 0
+	for _, l := range clLengths {
+		if l > 0 {
+			nUsed++
+		}
+	}
+	if nUsed == 1 { // make sure the code length code has two symbols
+		for i := range clLengths {
+			if clLengths[i] == 0 {
+				clLengths[i] = 1
+				break
+			}
+		}
+	}
+	clCodes := canonicalCodes(clLengths)
+
+	numCodes := 4
+	for i, symbol := range vp8lCodeLengthCodeOrder {
+		if clLengths[symbol] > 0 && i+1 > numCodes {
+			numCodes = i + 1
+		}
+	}
+	bw.writeBits(0, 1) // normal code
+	bw.writeBits(uint32(numCodes-4), 4)
+	for _, symbol := range vp8lCodeLengthCodeOrder[:numCodes] {
+		bw.writeBits(uint32(clLengths[symbol]), 3)
+	}
+	bw.writeBits(0, 1) // max_symbol is alphabet size
+	for _, l := range lengths {
+		bw.writeBits(clCodes[l], uint(clLengths[l]))
+	}
+	return &vp8lPrefixCode{lengths: lengths, codes: canonicalCodes(lengths)}
+}
+
+// vp8lPrefixEncode convert LZ77 length or distance value to (symbol, extra bits count, extra value)
+func vp8lPrefixEncode(value int) (symbol int, nbits uint, extra uint32) {
+	v := value - 1
+	if v < 4 {
+		return v, 0, 0
+	}
+	h := uint(0)
+	for (v >> (h + 1)) > 0 {
+		h++
+	}
+	second := (v >> (h - 1)) & 1
+	nbits = h - 1
+	return int(2*h) + second, nbits, uint32(v) & (1<<nbits - 1)
+}
+
+type vp8lToken struct {
+	argb   uint32
+	length int // > 0 means backward reference to the left pixel
+}
+
+// vp8lWriteImage entropy code argb pixels, used for both main image and sub images
+func vp8lWriteImage(bw *vp8lBitWriter, argb []uint32, isMain bool) {
+	tokens := make([]vp8lToken, 0, len(argb)/4+1)
+	for i := 0; i < len(argb); {
+		run := 0
+		if i > 0 {
+			for i+run < len(argb) && argb[i+run] == argb[i-1] && run < vp8lMaxCopyLength {
+				run++
+			}
+		}
+		if run >= 3 {
+			tokens = append(tokens, vp8lToken{length: run})
+			i += run
+		} else {
+			tokens = append(tokens, vp8lToken{argb: argb[i]})
+			i++
+		}
+	}
+
+	var (
+		green = make([]uint32, vp8lNumLiterals+vp8lNumLengthCodes)
+		red   = make([]uint32, vp8lNumLiterals)
+		blue  = make([]uint32, vp8lNumLiterals)
+		alpha = make([]uint32, vp8lNumLiterals)
+		dist  = make([]uint32, vp8lNumDistanceCodes)
+	)
+	distSymbol, distBits, distExtra := vp8lPrefixEncode(vp8lDistanceCodeLeft)
+	for _, t := range tokens {
+		if t.length > 0 {
+			symbol, _, _ := vp8lPrefixEncode(t.length)
+			green[vp8lNumLiterals+symbol]++
+			dist[distSymbol]++
+			continue
+		}
+		alpha[t.argb>>24]++
+		red[(t.argb>>16)&0xff]++
+		green[(t.argb>>8)&0xff]++
+		blue[t.argb&0xff]++
+	}
+
+	bw.writeBits(0, 1) // no color cache
+	if isMain {
+		bw.writeBits(0, 1) // no meta prefix codes
+	}
+	greenCode := writePrefixCode(bw, green)
+	redCode := writePrefixCode(bw, red)
+	blueCode := writePrefixCode(bw, blue)
+	alphaCode := writePrefixCode(bw, alpha)
+	distCode := writePrefixCode(bw, dist)
+
+	for _, t := range tokens {
+		if t.length > 0 {
+			symbol, nbits, extra := vp8lPrefixEncode(t.length)
+			greenCode.write(bw, vp8lNumLiterals+symbol)
+			bw.writeBits(extra, nbits)
+			distCode.write(bw, distSymbol)
+			bw.writeBits(distExtra, distBits)
+			continue
+		}
+		greenCode.write(bw, int((t.argb>>8)&0xff))
+		redCode.write(bw, int((t.argb>>16)&0xff))
+		blueCode.write(bw, int(t.argb&0xff))
+		alphaCode.write(bw, int(t.argb>>24))
+	}
+}
+
+func vp8lSubPixels(a, b uint32) uint32 {
+	alphaAndGreen := 0x00ff00ff + (a & 0xff00ff00) - (b & 0xff00ff00)
+	redAndBlue := 0xff00ff00 + (a & 0x00ff00ff) - (b & 0x00ff00ff)
+	return (alphaAndGreen & 0xff00ff00) | (redAndBlue & 0x00ff00ff)
+}
+
+// encodeWebP write img as lossless webp
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || width > vp8lMaxSize || height > vp8lMaxSize {
+		return errors.Errorf("webp: invalid image size %dx%d", width, height)
+	}
+
+	argb := make([]uint32, width*height)
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			// webp store non-premultiplied color
+			c := nrgbaAt(img, bounds.Min.X+x, bounds.Min.Y+y)
+			if c.A != 0xff {
+				hasAlpha = true
+			}
+			// subtract green transform
+			argb[y*width+x] = uint32(c.A)<<24 | uint32(c.R-c.G)<<16 | uint32(c.G)<<8 | uint32(c.B-c.G)
+		}
+	}
+	// predictor transform, go backward so the original neighbours are still there
+	for y := height - 1; y >= 0; y-- {
+		for x := width - 1; x >= 0; x-- {
+			var pred uint32
+			switch {
+			case x == 0 && y == 0:
+				pred = 0xff000000
+			case x == 0:
+				pred = argb[(y-1)*width]
+			default:
+				pred = argb[y*width+x-1]
+			}
+			argb[y*width+x] = vp8lSubPixels(argb[y*width+x], pred)
+		}
+	}
+
+	bw := &vp8lBitWriter{}
+	bw.writeBits(0x2f, 8) // signature
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	if hasAlpha {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	bw.writeBits(0, 3) // version
+
+	// decoder invert transforms in reverse order
+	bw.writeBits(1, 1)
+	bw.writeBits(vp8lTransformSubtractGreen, 2)
+	bw.writeBits(1, 1)
+	bw.writeBits(vp8lTransformPredictor, 2)
+	bw.writeBits(vp8lPredictorSizeBits-2, 3)
+	blockSize := 1 << vp8lPredictorSizeBits
+	modes := make([]uint32, ((width+blockSize-1)/blockSize)*((height+blockSize-1)/blockSize))
+	for i := range modes {
+		modes[i] = vp8lPredictorModeL << 8 // mode is stored in green
+	}
+	vp8lWriteImage(bw, modes, false)
+	bw.writeBits(0, 1) // no more transform
+
+	vp8lWriteImage(bw, argb, true)
+	bw.flush()
+
+	data := bw.buf
+	padding := len(data) & 1
+	header := make([]byte, 20)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(4+8+len(data)+padding))
+	copy(header[8:16], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:20], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if padding == 1 {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
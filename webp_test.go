@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHuffmanCodeLengths(t *testing.T) {
+	hist := make([]uint32, 256)
+	for i := range hist {
+		hist[i] = 1 << uint(i%30) // very skewed, need length limit
+	}
+	lengths := huffmanCodeLengths(hist, vp8lMaxCodeLength)
+	kraft := 0.0
+	for _, l := range lengths {
+		assert.True(t, l > 0 && l <= vp8lMaxCodeLength)
+		kraft += 1.0 / float64(uint(1)<<uint(l))
+	}
+	assert.Equal(t, 1.0, kraft) // code must be complete
+
+	lengths = huffmanCodeLengths([]uint32{0, 0, 5, 0}, vp8lMaxCodeLength)
+	assert.Equal(t, []int{0, 0, 1, 0}, lengths)
+}
+
+func TestVP8LPrefixEncode(t *testing.T) {
+	// decode as the spec does
+	for value := 1; value <= vp8lMaxCopyLength; value++ {
+		symbol, nbits, extra := vp8lPrefixEncode(value)
+		var decoded int
+		if symbol < 4 {
+			decoded = symbol + 1
+		} else {
+			extraBits := uint(symbol-2) >> 1
+			assert.Equal(t, extraBits, nbits)
+			offset := (2 + symbol&1) << extraBits
+			decoded = offset + int(extra) + 1
+		}
+		assert.Equal(t, value, decoded)
+		assert.True(t, symbol < vp8lNumLengthCodes)
+	}
+}
+
+func TestEncodeWebP(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 30; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 8), uint8(y * 12), 100, 255})
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	assert.Nil(t, encodeWebP(buf, img))
+	data := buf.Bytes()
+	assert.Equal(t, "RIFF", string(data[0:4]))
+	assert.Equal(t, uint32(len(data)-8), binary.LittleEndian.Uint32(data[4:8]))
+	assert.Equal(t, "WEBPVP8L", string(data[8:16]))
+	assert.Equal(t, byte(0x2f), data[20])
+	bits := binary.LittleEndian.Uint32(data[21:25])
+	assert.Equal(t, uint32(29), bits&0x3fff)
+	assert.Equal(t, uint32(19), (bits>>14)&0x3fff)
+
+	assert.NotNil(t, encodeWebP(buf, image.NewNRGBA(image.Rect(0, 0, 0, 0))))
+}
+
+func TestResizeImage(t *testing.T) {
+	w, h := fitSize(1080, 1920, 800, 800)
+	assert.Equal(t, 450, w)
+	assert.Equal(t, 800, h)
+	w, h = fitSize(100, 50, 0, 0)
+	assert.Equal(t, 100, w)
+	assert.Equal(t, 50, h)
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		c := uint8(0)
+		if x%2 == 1 {
+			c = 200
+		}
+		img.Set(x, 0, color.RGBA{c, c, c, 255})
+		img.Set(x, 1, color.RGBA{c, c, c, 255})
+	}
+	small := resizeImage(img, 2, 2)
+	assert.Equal(t, image.Rect(0, 0, 2, 1), small.Bounds())
+	assert.Equal(t, color.RGBA{100, 100, 100, 255}, small.At(0, 0))
+}